@@ -4,6 +4,8 @@ package castX
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/dosgo/castX/castxServer"
 	"github.com/dosgo/castX/comm"
@@ -14,11 +16,115 @@ import (
 var castx *castxServer.Castx
 var webrtcReceive *comm.WebrtcReceive
 var scrcpyClient *scrcpy.ScrcpyClient
+var receiveLatency int
 
 func Start(webPort int, width int, height int, mimeType string, password string, receiverPort int) {
 	castx, _ = castxServer.Start(webPort, width, height, mimeType, false, password, receiverPort)
 }
 
+// 开启rtsp输出 rtsp://ip:port/default
+func StartRtsp(port int) bool {
+	if castx == nil {
+		return false
+	}
+	return castx.StartRtsp(port) == nil
+}
+
+// WHEP/WHIP等接口的Bearer token,不设置时用连接密码;没有密码和token时拒绝WHIP推流
+func SetStreamToken(token string) {
+	if castx != nil {
+		castx.Config.StreamToken = token
+	}
+}
+
+// 设置stun/turn服务器,格式 "stun:host:port,turn:host:port|user|pass",secret为turn REST共享密钥
+func SetIceServers(value string, secret string) {
+	if castx != nil {
+		castx.Config.IceServers = comm.ParseIceServers(value)
+		castx.Config.TurnSecret = secret
+	}
+}
+
+// 设置ice固定端口,udpPort为所有连接共用的udp端口,tcpPort为ice-tcp端口,nat1To1IPs逗号分隔
+func SetIceNetwork(udpPort int, tcpPort int, nat1To1IPs string) {
+	if castx == nil {
+		return
+	}
+	castx.Config.IceUdpPort = udpPort
+	castx.Config.IceTcpPort = tcpPort
+	castx.Config.NAT1To1IPs = nil
+	for _, ip := range strings.Split(nat1To1IPs, ",") {
+		if ip = strings.TrimSpace(ip); len(ip) > 0 {
+			castx.Config.NAT1To1IPs = append(castx.Config.NAT1To1IPs, ip)
+		}
+	}
+	//下一个连接按新配置重新监听
+	castx.WebrtcServer.CloseIce()
+}
+
+// 自适应码率,mode为min/median,为空时只估计不调整,bitRate为MediaCodec当前码率
+func SetAbr(mode string, bitRate int, minBitRate int, maxBitRate int) {
+	if castx == nil {
+		return
+	}
+	castx.Config.AbrMode = mode
+	castx.Config.SetBitRate(bitRate)
+	castx.Config.AbrMinBitRate = minBitRate
+	castx.Config.AbrMaxBitRate = maxBitRate
+}
+
+// 级联中继,upstream为上游castX的http地址,password为上游密码,streamToken为上游的StreamToken(没有设置时传空)
+func StartRelay(upstream string, password string, streamToken string) string {
+	if castx == nil {
+		return "not start"
+	}
+	if err := castx.StartRelay(upstream, password, streamToken); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func CloseRelay() {
+	if castx != nil {
+		castx.CloseRelay()
+	}
+}
+
+// rtmp/rtmps推流,audio为true时带opus音频(需要服务端支持enhanced rtmp),返回错误信息
+func StartRtmp(url string, audio bool) string {
+	if castx == nil {
+		return "not start"
+	}
+	if err := castx.StartRtmp(url, audio); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func StopRtmp() {
+	if castx != nil {
+		castx.StopRtmp()
+	}
+}
+
+// LL-HLS分片毫秒、part毫秒和保留分片数,0为默认值,播放地址通过POST /hls获取
+func SetHls(segmentMs int, partMs int, segments int) {
+	if castx == nil {
+		return
+	}
+	castx.Config.HlsSegmentDuration = segmentMs
+	castx.Config.HlsPartDuration = partMs
+	castx.Config.HlsSegments = segments
+}
+
+// 启动内置turn中继
+func StartTurn(listen string, realm string) bool {
+	if castx == nil {
+		return false
+	}
+	return castx.StartTurn(listen, realm) == nil
+}
+
 func SendVideo(nal []byte, timestamp int64) {
 	if castx != nil {
 		castx.WebrtcServer.SendVideo(nal, timestamp)
@@ -41,12 +147,15 @@ func Shutdown() {
 		if castx.ScrcpyReceiver != nil {
 			castx.CloseScrcpyReceiver()
 		}
+		castx.CloseRtsp()
+		castx.CloseTurn()
+		castx.CloseRelay()
 	}
 }
 
 type JavaCallbackInterface interface {
 	CallString(param string)
-	CallBytes(cmd int, param []byte, timestamp int64)
+	CallBytes(cmd int, param []byte, timestamp int64) //cmd见comm.ReceiveCmdVideo等
 	WebRtcConnectionStateChange(count int)
 	SetMaxSize(maxsize int)
 }
@@ -72,6 +181,14 @@ func RegJavaClass(c JavaCallbackInterface) {
 			javaObj.JavaCall.CallBytes(cmd, data, timestamp)
 		})
 	}
+	//请求关键帧通过控制消息通知java端,由MediaCodec输出关键帧
+	castx.WebrtcServer.SetKeyFrameRequestFun(func() {
+		javaObj.JavaCall.CallString(`{"type":"requestKeyFrame"}`)
+	})
+	//带宽变化时通知java端调整MediaCodec码率
+	castx.WebrtcServer.SetBitRateFun(func(bitRate int) {
+		javaObj.JavaCall.CallString(fmt.Sprintf(`{"type":"setBitRate","bitRate":%d}`, bitRate))
+	}, false)
 	castx.WebrtcServer.SetWebRtcConnectionStateChange(func(count int) {
 		javaObj.JavaCall.WebRtcConnectionStateChange(count)
 	})
@@ -90,9 +207,33 @@ func RegJavaClass(c JavaCallbackInterface) {
 	})
 }
 
-func StartWebRtcReceive(url string) {
+// 拉流抖动缓冲的毫秒数,在StartWebRtcReceive之前调用,0为默认值
+func SetReceiveLatency(ms int) {
+	receiveLatency = ms
+}
+
+// url为对端的WHEP地址,password为对端的StreamToken(没有设置时为连接密码),返回错误信息,成功时为空
+func StartWebRtcReceive(url string, password string) string {
 	webrtcReceive = &comm.WebrtcReceive{}
-	webrtcReceive.StartWebRtcReceive(url, false)
+	webrtcReceive.SetToken(password)
+	webrtcReceive.SetLatency(receiveLatency)
+	if castx != nil {
+		webrtcReceive.SetIceServers(castx.Config.IceServerList())
+		if iceTransport, err := castx.WebrtcServer.IceTransport(); err == nil {
+			webrtcReceive.SetIceTransport(iceTransport)
+		}
+	}
+	if err := webrtcReceive.StartWebRtcReceive(url, false); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func StopWebRtcReceive() {
+	if webrtcReceive != nil {
+		webrtcReceive.Close()
+		webrtcReceive = nil
+	}
 }
 
 func SetSize(width int, height int, videoWidth int, videoHeight int, orientation int) {
@@ -0,0 +1,154 @@
+package main
+
+/*
+推流压测,本机启动castx服务,用WHEP建立多个观看端,按固定帧率推送模拟的h264数据,
+统计采集线程每帧的耗时和每个观看端收到的包数,慢观看端每个包读取后都会暂停一段时间
+go run ./bench -peers 12 -slow 2 -seconds 10
+*/
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dosgo/castX/castxServer"
+	"github.com/pion/webrtc/v3"
+)
+
+type viewer struct {
+	peerConnection *webrtc.PeerConnection
+	slow           bool
+	packets        int64
+	frames         int64
+	lost           int64
+}
+
+func main() {
+	port := flag.Int("port", 18081, "web port")
+	peers := flag.Int("peers", 12, "viewer count")
+	slow := flag.Int("slow", 2, "slow viewer count")
+	seconds := flag.Int("seconds", 10, "push seconds")
+	fps := flag.Int("fps", 60, "frame rate")
+	frameSize := flag.Int("size", 20000, "p frame size")
+	gop := flag.Int("gop", 120, "keyframe interval (frames)")
+	flag.Parse()
+
+	castx, err := castxServer.Start(*port, 1920, 1080, "", false, "bench", 0)
+	if err != nil {
+		fmt.Printf("start err:%+v\r\n", err)
+		return
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%d/whep", *port)
+	viewers := make([]*viewer, 0, *peers)
+	for i := 0; i < *peers; i++ {
+		viewer, err := newViewer(url, i < *slow)
+		if err != nil {
+			fmt.Printf("viewer %d err:%+v\r\n", i, err)
+			return
+		}
+		viewers = append(viewers, viewer)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for castx.WebrtcServer.PeerCount() < *peers && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("connected %d/%d\r\n", castx.WebrtcServer.PeerCount(), *peers)
+
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42, 0xe0, 0x1f, 0xda, 0x01}
+	pps := []byte{0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80}
+	keyFrame := append(append(append([]byte{}, sps...), pps...), append([]byte{0, 0, 0, 1, 0x65}, make([]byte, *frameSize*5)...)...)
+	frame := append([]byte{0, 0, 0, 1, 0x41}, make([]byte, *frameSize)...)
+	total := *seconds * *fps
+	costs := make([]time.Duration, 0, total)
+	interval := time.Second / time.Duration(*fps)
+	ticker := time.NewTicker(interval)
+	start := time.Now()
+	for i := 0; i < total; i++ {
+		<-ticker.C
+		data := frame
+		if i%*gop == 0 {
+			data = keyFrame
+		}
+		timestamp := time.Since(start).Microseconds()
+		begin := time.Now()
+		castx.WebrtcServer.SendVideo(data, timestamp)
+		costs = append(costs, time.Since(begin))
+	}
+	ticker.Stop()
+	time.Sleep(time.Second)
+
+	sort.Slice(costs, func(i, j int) bool { return costs[i] < costs[j] })
+	fmt.Printf("frames:%d ingest p50:%v p99:%v max:%v\r\n", total, costs[len(costs)/2], costs[len(costs)*99/100], costs[len(costs)-1])
+	for i, viewer := range viewers {
+		fmt.Printf("viewer %2d slow:%-5v packets:%d frames:%d lost:%d\r\n", i, viewer.slow,
+			atomic.LoadInt64(&viewer.packets), atomic.LoadInt64(&viewer.frames), atomic.LoadInt64(&viewer.lost))
+		viewer.peerConnection.Close()
+	}
+	castx.WsServer.Shutdown()
+	castx.HttpServer.Shutdown()
+}
+
+func newViewer(url string, slow bool) (*viewer, error) {
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	viewer := &viewer{peerConnection: peerConnection, slow: slow}
+	peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		var lastSeq uint16
+		for i := 0; ; i++ {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			//重传的包序号比之前小,不算丢包
+			gap := int16(packet.SequenceNumber - lastSeq - 1)
+			if i > 0 && gap < 0 {
+				continue
+			}
+			if i > 0 && gap > 0 {
+				atomic.AddInt64(&viewer.lost, int64(gap))
+			}
+			lastSeq = packet.SequenceNumber
+			atomic.AddInt64(&viewer.packets, 1)
+			if packet.Marker {
+				atomic.AddInt64(&viewer.frames, 1)
+			}
+			if slow {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	})
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gatherCompletePromise := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	<-gatherCompletePromise
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte(peerConnection.LocalDescription().SDP)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	req.Header.Set("Authorization", "Bearer bench")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("whep status:%d %s", resp.StatusCode, body)
+	}
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)})
+	return viewer, err
+}
@@ -15,6 +15,9 @@ type Castx struct {
 	HttpServer     *comm.HttpServer
 	Config         *comm.Config
 	ScrcpyReceiver *ScrcpyReceiver
+	RtspServer     *comm.RtspServer
+	TurnServer     *comm.TurnServer
+	Relay          *comm.Relay
 }
 
 func Start(webPort int, width int, height int, _mimeType string, useAdb bool, password string, receiverPort int) (*Castx, error) {
@@ -33,6 +36,7 @@ func Start(webPort int, width int, height int, _mimeType string, useAdb bool, pa
 	if err != nil {
 		return nil, err
 	}
+	castx.WebrtcServer.SetConfig(castx.Config)
 	castx.WsServer = comm.NewWs(castx.Config, castx.WebrtcServer)
 	castx.HttpServer, err = comm.StartWeb(webPort, castx.WsServer)
 	if receiverPort > 0 {
@@ -41,12 +45,90 @@ func Start(webPort int, width int, height int, _mimeType string, useAdb bool, pa
 	}
 	return castx, nil
 }
+
+// 启动rtsp输出,和webrtc共用同一份数据
+func (castx *Castx) StartRtsp(port int) error {
+	if castx.RtspServer != nil {
+		return nil
+	}
+	rtspServer, err := comm.StartRtsp(port, castx.Config, castx.WebrtcServer)
+	if err != nil {
+		return err
+	}
+	castx.RtspServer = rtspServer
+	return nil
+}
+
+func (castx *Castx) CloseRtsp() {
+	if castx.RtspServer != nil {
+		castx.RtspServer.Shutdown()
+		castx.RtspServer = nil
+	}
+}
+
+// 启动内置turn中继,listen例如:3478
+func (castx *Castx) StartTurn(listen string, realm string) error {
+	if castx.TurnServer != nil {
+		return nil
+	}
+	castx.Config.TurnListen = listen
+	castx.Config.TurnRealm = realm
+	turnServer, err := comm.StartTurn(castx.Config)
+	if err != nil {
+		castx.Config.TurnListen = ""
+		return err
+	}
+	castx.TurnServer = turnServer
+	return nil
+}
+
+func (castx *Castx) CloseTurn() {
+	if castx.TurnServer != nil {
+		castx.TurnServer.Close()
+		castx.TurnServer = nil
+		castx.Config.TurnListen = ""
+	}
+}
+
+// 级联中继,拉取上游castX(例如 http://192.168.1.10:8081)的画面再转发,上游设置了StreamToken时需要传入
+func (castx *Castx) StartRelay(upstream string, password string, streamToken string) error {
+	if castx.Relay != nil {
+		return nil
+	}
+	relay, err := comm.StartRelay(upstream, password, streamToken, castx.WsServer)
+	if err != nil {
+		return err
+	}
+	castx.Relay = relay
+	return nil
+}
+
+func (castx *Castx) CloseRelay() {
+	if castx.Relay != nil {
+		castx.Relay.Close()
+		castx.Relay = nil
+	}
+}
+
+// rtmp/rtmps推流,例如 rtmp://127.0.0.1/live/streamKey,断线自动重连
+func (castx *Castx) StartRtmp(url string, audio bool) error {
+	return castx.WsServer.Rtmp().Start(url, audio)
+}
+
+func (castx *Castx) StopRtmp() {
+	if castx.WsServer.Rtmp().Running() {
+		castx.WsServer.Rtmp().Stop()
+	}
+}
+
 func (castx *Castx) UpdateConfig(width int, height int, _videoWidth int, _videoHeight int, _orientation int) {
-	castx.Config.ScreenWidth = width
-	castx.Config.ScreenHeight = height
-	castx.Config.VideoWidth = _videoWidth
-	castx.Config.VideoHeight = _videoHeight
-	castx.Config.Orientation = _orientation
+	castx.Config.UpdateInfo(func(info *comm.ScreenInfo) {
+		info.ScreenWidth = width
+		info.ScreenHeight = height
+		info.VideoWidth = _videoWidth
+		info.VideoHeight = _videoHeight
+		info.Orientation = _orientation
+	})
 	castx.WsServer.BroadcastInfo()
 }
 
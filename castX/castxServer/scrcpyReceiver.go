@@ -117,7 +117,7 @@ func (castx *Castx) handleVideo(conn net.Conn) error {
 			castx.WebrtcServer.SendVideo(pps, int64(h.PTS))
 			pspInfo, _ := comm.ParseSPS(sps[4:])
 
-			if pspInfo.Width != castx.Config.ScreenWidth && castx.Config.UseAdb {
+			if info := castx.Config.Info(); pspInfo.Width != info.ScreenWidth && info.UseAdb {
 				castx.UpdateConfig(pspInfo.Width, pspInfo.Height, pspInfo.Width, pspInfo.Height, 0)
 			}
 			continue
@@ -148,6 +148,8 @@ func (castx *Castx) handleConnection(conn net.Conn) {
 	switch socketType {
 	case 1:
 		castx.handleVideo(conn)
+		//设备断开,结束录制文件等
+		castx.WebrtcServer.StreamEnd()
 	case 2:
 		castx.handleAudio(conn)
 	case 3:
@@ -180,10 +182,11 @@ func (castx *Castx) startReceiver(port int) {
 			}
 			fmt.Printf("接收到连接: %s\n", conn.RemoteAddr()) // 打印连接信息
 			//adb使用scrcpy才有第一个连接发送设备名字
-			if castx.Config.UseAdb && castx.ScrcpyReceiver.Counter == 0 {
+			if castx.Config.Info().UseAdb && castx.ScrcpyReceiver.Counter == 0 {
 				deviceName := make([]byte, 64)
 				io.ReadFull(conn, deviceName)
 				fmt.Printf("设备名称:%s\r\n", deviceName)
+				castx.Config.DeviceName = string(bytes.TrimRight(deviceName, "\x00"))
 			}
 			go castx.handleConnection(conn) // 为每个连接启动goroutine
 			castx.ScrcpyReceiver.Counter++
@@ -226,7 +229,7 @@ func (castx *Castx) readHeader(conn net.Conn) (int, error) {
 		videoHeight := int(binary.BigEndian.Uint32(paramData[4:8]))
 		fmt.Printf("视频width:%d\n", binary.BigEndian.Uint32(paramData[0:4]))
 		fmt.Printf("视频Height:%d\n", binary.BigEndian.Uint32(paramData[4:8])) // 打印视频参数，实际使用时需要解析并处理这些参数，这里仅打印示例
-		if castx.Config.UseAdb {
+		if castx.Config.Info().UseAdb {
 			castx.UpdateConfig(videoWidth, videoHeight, videoWidth, videoHeight, 0)
 		}
 		return 1, nil
@@ -11,8 +11,11 @@ func main() {
 	webRtcReceive.SetReceiveCall(func(cmd int, data []byte, timestamp int64) {
 		fmt.Printf("test")
 	})
-	webRtcReceive.StartWebRtcReceive("http://127.0.0.1:8081/sendOffer", true)
-	fmt.Printf("eee\r\n")
+	webRtcReceive.SetToken("123456")
+	if err := webRtcReceive.StartWebRtcReceive("http://127.0.0.1:8081/whep", true); err != nil {
+		fmt.Printf("StartWebRtcReceive err:%+v\r\n", err)
+		return
+	}
 	// 保持运行
 	select {}
 }
@@ -0,0 +1,202 @@
+package comm
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	abrInterval       = time.Second
+	abrHeadroom       = 0.85             //目标码率留出余量,音频、重传也要占带宽
+	abrDownRatio      = 0.8              //低于当前码率80%立即降
+	abrUpRatio        = 1.25             //高于当前码率125%并持续abrUpHold才升
+	abrUpHold         = 10 * time.Second //升码率需要持续的时间
+	abrUpStep         = 1.5              //每次最多升到当前码率的1.5倍
+	abrMinChangeTime  = 3 * time.Second  //两次调整的最小间隔
+	abrRestartTime    = 60 * time.Second //每次调整都要重启编码端(scrcpy、ffmpeg)时的最小间隔
+	defaultBitRate    = 4000000
+	defaultMinBitRate = 500000
+)
+
+/*
+自适应码率,每个观看端用发送端带宽估计(GCC,基于TWCC反馈),
+按最差或者中间的观看端得出目标码率,通过回调让编码端调整(重启scrcpy、修改ffmpeg参数等)
+降码率快、升码率慢,避免来回抖动
+*/
+type abrController struct {
+	current    int
+	upSince    time.Time
+	lastChange time.Time
+	minChange  time.Duration //两次调整的最小间隔,为0时用abrMinChangeTime
+}
+
+// 根据估计带宽计算新的码率,不需要调整时返回false
+func (abr *abrController) update(estimate int, minBitRate int, maxBitRate int, now time.Time) (int, bool) {
+	target := min(max(int(float64(estimate)*abrHeadroom), minBitRate), maxBitRate)
+	minChange := abr.minChange
+	if minChange <= 0 {
+		minChange = abrMinChangeTime
+	}
+	if now.Sub(abr.lastChange) < minChange {
+		return abr.current, false
+	}
+	if target < int(float64(abr.current)*abrDownRatio) {
+		abr.upSince = time.Time{}
+		abr.current = target
+		abr.lastChange = now
+		return target, true
+	}
+	if target > int(float64(abr.current)*abrUpRatio) {
+		if abr.upSince.IsZero() {
+			abr.upSince = now
+		}
+		if now.Sub(abr.upSince) >= abrUpHold {
+			abr.upSince = time.Time{}
+			abr.current = min(target, int(float64(abr.current)*abrUpStep))
+			abr.lastChange = now
+			return abr.current, true
+		}
+		return abr.current, false
+	}
+	abr.upSince = time.Time{}
+	return abr.current, false
+}
+
+// 编码端调整码率的回调,参数为bps,restart表示每次调整都要重启编码端,拉长两次调整的间隔
+func (webrtcServer *WebrtcServer) SetBitRateFun(bitRateCall func(int), restart bool) {
+	webrtcServer.abrMu.Lock()
+	defer webrtcServer.abrMu.Unlock()
+	webrtcServer.bitRateCall = bitRateCall
+	webrtcServer.abr.minChange = abrMinChangeTime
+	if restart {
+		webrtcServer.abr.minChange = abrRestartTime
+	}
+}
+
+// 当前编码码率和观看端的带宽估计,没有观看端时估计为0
+func (webrtcServer *WebrtcServer) BitRate() (int, int) {
+	webrtcServer.abrMu.Lock()
+	defer webrtcServer.abrMu.Unlock()
+	return webrtcServer.abr.current, webrtcServer.estimate
+}
+
+func (webrtcServer *WebrtcServer) bitRateConfig() (string, int, int, int) {
+	config := webrtcServer.config
+	if config == nil {
+		config = &Config{}
+	}
+	bitRate := config.BitRate()
+	if bitRate <= 0 {
+		bitRate = defaultBitRate
+	}
+	minBitRate := config.AbrMinBitRate
+	if minBitRate <= 0 {
+		minBitRate = defaultMinBitRate
+	}
+	maxBitRate := config.AbrMaxBitRate
+	if maxBitRate <= 0 {
+		maxBitRate = bitRate
+	}
+	return config.AbrMode, bitRate, minBitRate, maxBitRate
+}
+
+// 注册带宽估计拦截器,新连接的估计器通过newEstimator取出
+func (webrtcServer *WebrtcServer) registerCongestionControl(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	_, bitRate, minBitRate, maxBitRate := webrtcServer.bitRateConfig()
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		//不做发送整形,采集线程已经按帧写入,整形只会增加延迟
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(bitRate),
+			gcc.SendSideBWEMinBitrate(minBitRate),
+			gcc.SendSideBWEMaxBitrate(max(maxBitRate, bitRate)*2),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	//创建PeerConnection时同步回调,调用方持有newPeerMu
+	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		webrtcServer.newEstimator = estimator
+	})
+	registry.Add(congestionController)
+	return webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry)
+}
+
+// 有观看端时每秒汇总一次带宽估计,没有观看端后退出
+func (webrtcServer *WebrtcServer) startAbr() {
+	webrtcServer.abrMu.Lock()
+	defer webrtcServer.abrMu.Unlock()
+	if webrtcServer.abrRunning {
+		return
+	}
+	webrtcServer.abrRunning = true
+	go webrtcServer.abrLoop()
+}
+
+func (webrtcServer *WebrtcServer) abrLoop() {
+	ticker := time.NewTicker(abrInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !webrtcServer.abrTick() {
+			return
+		}
+	}
+}
+
+func (webrtcServer *WebrtcServer) abrTick() bool {
+	webrtcServer.peerMu.Lock()
+	estimates := make([]int, 0, len(webrtcServer.peers))
+	for _, peer := range webrtcServer.peers {
+		if peer.connected && peer.estimator != nil {
+			estimates = append(estimates, peer.estimator.GetTargetBitrate())
+		}
+	}
+	webrtcServer.peerMu.Unlock()
+
+	mode, bitRate, minBitRate, maxBitRate := webrtcServer.bitRateConfig()
+	webrtcServer.abrMu.Lock()
+	if webrtcServer.abr.current == 0 {
+		webrtcServer.abr.current = bitRate
+	}
+	if len(estimates) == 0 {
+		webrtcServer.abrRunning = false
+		webrtcServer.estimate = 0
+		webrtcServer.notifiedEstimate = 0
+		webrtcServer.abrMu.Unlock()
+		return false
+	}
+	sort.Ints(estimates)
+	estimate := estimates[0]
+	if mode == "median" {
+		estimate = estimates[len(estimates)/2]
+	}
+	changed := false
+	current := webrtcServer.abr.current
+	bitRateCall := webrtcServer.bitRateCall
+	if (mode == "min" || mode == "median") && bitRateCall != nil {
+		current, changed = webrtcServer.abr.update(estimate, minBitRate, maxBitRate, time.Now())
+	}
+	//和上次通知相差超过10%才通知观看端
+	notified := webrtcServer.notifiedEstimate
+	notify := changed || estimate < notified*9/10 || estimate > notified*11/10
+	if notify {
+		webrtcServer.notifiedEstimate = estimate
+	}
+	webrtcServer.estimate = estimate
+	estimateCall := webrtcServer.estimateCall
+	webrtcServer.abrMu.Unlock()
+
+	if changed {
+		bitRateCall(current)
+	}
+	if notify && estimateCall != nil {
+		estimateCall(current, estimate)
+	}
+	return true
+}
@@ -1,15 +1,99 @@
 package comm
 
-type Config struct {
+import "sync"
+
+// 屏幕尺寸、方向和adb状态,运行中会被中继、scrcpy等协程更新
+type ScreenInfo struct {
 	ScreenWidth  int
 	ScreenHeight int
 	VideoWidth   int
 	VideoHeight  int
-	MimeType     string
 	Orientation  int
 	UseAdb       bool
 	AdbConnect   bool
-	SecurityKey  string
-	Password     string
-	MaxSize      int
+}
+
+type Config struct {
+	ScreenInfo               //启动后通过Info/UpdateInfo读写
+	infoMu      sync.RWMutex //保护ScreenInfo和VideoBitRate
+	MimeType    string
+	SecurityKey string
+	Password    string
+	StreamToken string //WHEP/WHIP等接口的Bearer token,为空时用Password
+	MaxSize     int
+	DeviceName  string //adb设备名,由scrcpy第一个连接上报
+	//logcat落盘配置,LogcatDir为空时不落盘
+	LogcatDir      string
+	LogcatMaxSize  int64  //单个文件最大字节数
+	LogcatMaxFiles int    //最多保留文件数
+	RecordDir      string //录制文件目录,默认recordings
+	ReplaySeconds  int    //即时回放缓存秒数,大于0时启动就开始缓存
+	ReplayMaxBytes int    //即时回放最大内存,默认64M
+	IceServers     []IceServer
+	TurnSecret     string //turn REST共享密钥,设置后turn地址下发临时账号
+	TurnTTL        int    //临时账号有效秒数,默认86400
+	TurnListen     string //内置turn服务监听地址,例如:3478,为空不启动
+	TurnRealm      string //内置turn的realm,默认castx
+	TurnPublicIP   string //内置turn的中继地址,为空时取本机局域网ip
+	//ice网络配置,防火墙只需要放开固定端口
+	IceUdpPort       int      //所有连接共用的ice udp端口,0为随机端口
+	IceTcpPort       int      //ice-tcp监听端口,0不启用
+	NAT1To1IPs       []string //公网映射ip,作为host候选地址下发
+	IceInterfaces    []string //只使用这些网卡,为空不过滤
+	IceIPs           []string //只使用这些ip或网段(CIDR),为空不过滤
+	EphemeralPortMin uint16   //没有共用端口时随机端口范围
+	EphemeralPortMax uint16
+	KeyFrameInterval int //两次关键帧请求的最小间隔毫秒,默认1000
+	//自适应码率
+	VideoBitRate  int    //编码码率bps,默认4000000,启动后通过BitRate/SetBitRate读写
+	AbrMode       string //min按最差的观看端,median按中间的观看端,为空只估计不调整
+	AbrMinBitRate int    //最低码率,默认500000
+	AbrMaxBitRate int    //最高码率,默认VideoBitRate
+	//丢包修复
+	NackBufferSize int    //每个发送流缓存用于重传的包数,默认1024
+	NoRtx          bool   //不使用rtx,丢包直接在原ssrc上重传
+	Fec            string //flexfec启用前向纠错(对端需要支持flexfec-03),为空不启用
+	//LL-HLS
+	HlsSegmentDuration int //分片目标毫秒,默认2000,实际在下一个关键帧切分
+	HlsPartDuration    int //part目标毫秒,默认200
+	HlsSegments        int //播放列表保留的分片数,默认7
+}
+
+// stun/turn服务器,json格式和浏览器RTCIceServer一致
+type IceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// 判断api路径里的设备id是否是当前设备,default总是指向当前设备
+func (config *Config) MatchDevice(id string) bool {
+	return id == "default" || (len(config.DeviceName) > 0 && id == config.DeviceName)
+}
+
+// 屏幕信息的副本
+func (config *Config) Info() ScreenInfo {
+	config.infoMu.RLock()
+	defer config.infoMu.RUnlock()
+	return config.ScreenInfo
+}
+
+// 持有写锁修改屏幕信息
+func (config *Config) UpdateInfo(update func(info *ScreenInfo)) {
+	config.infoMu.Lock()
+	defer config.infoMu.Unlock()
+	update(&config.ScreenInfo)
+}
+
+// 当前编码码率,自适应码率会在运行中修改
+func (config *Config) BitRate() int {
+	config.infoMu.RLock()
+	defer config.infoMu.RUnlock()
+	return config.VideoBitRate
+}
+
+func (config *Config) SetBitRate(bitRate int) {
+	config.infoMu.Lock()
+	defer config.infoMu.Unlock()
+	config.VideoBitRate = bitRate
 }
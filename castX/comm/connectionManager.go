@@ -1,21 +1,22 @@
 package comm
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
 type ConnectionManager struct {
-	connections map[*websocket.Conn]bool
-	rwMutex     sync.RWMutex // 改为读写锁
+	connections map[*websocket.Conn]*sync.Mutex //每个连接一个写锁,websocket不支持并发写
+	rwMutex     sync.RWMutex                    // 改为读写锁
 }
 
 // 添加连接时使用写锁
 func (cm *ConnectionManager) Add(conn *websocket.Conn) {
 	cm.rwMutex.Lock()
 	defer cm.rwMutex.Unlock()
-	cm.connections[conn] = true
+	cm.connections[conn] = &sync.Mutex{}
 }
 
 // 移除连接时使用写锁
@@ -29,9 +30,24 @@ func (cm *ConnectionManager) Remove(conn *websocket.Conn) {
 func (cm *ConnectionManager) Broadcast(msg WSMessage) {
 	cm.rwMutex.RLock()
 	defer cm.rwMutex.RUnlock()
-	for conn := range cm.connections {
-		go func(c *websocket.Conn) { // 每个连接独立goroutine发送
+	for conn, writeMu := range cm.connections {
+		go func(c *websocket.Conn, mu *sync.Mutex) { // 每个连接独立goroutine发送
+			mu.Lock()
+			defer mu.Unlock()
 			c.WriteJSON(msg)
-		}(conn)
+		}(conn, writeMu)
 	}
 }
+
+// 给单个连接发消息,和广播共用写锁,连接不在管理器里时不写,避免无锁并发写
+func (cm *ConnectionManager) Send(conn *websocket.Conn, msg WSMessage) error {
+	cm.rwMutex.RLock()
+	writeMu, ok := cm.connections[conn]
+	cm.rwMutex.RUnlock()
+	if !ok {
+		return errors.New("connection not managed")
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	return conn.WriteJSON(msg)
+}
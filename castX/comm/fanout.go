@@ -0,0 +1,178 @@
+package comm
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	webrtcMtu        = 1200
+	peerQueueSize    = 256             //每个观看端最多缓存的帧数
+	gopReplayFrameTs = 90              //补发缓存帧时相邻帧的rtp时间戳间隔(1ms),让浏览器尽快解码到最新一帧
+	peerKeyFrameWait = 2 * time.Second //同一个观看端丢帧后请求关键帧的最小间隔
+)
+
+// 观看端的轨道,测试时可以换成其他实现
+type rtpTrackWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// 打包好的一帧,所有观看端共用,写入时只改序号和时间戳
+type rtpFrame struct {
+	audio    bool
+	keyFrame bool
+	packets  []*rtp.Packet
+}
+
+/*
+每个观看端一个有界队列和写协程,采集线程只负责入队,不会被慢的观看端卡住
+队列写满后丢弃视频,直到下一个关键帧再恢复,同时请求关键帧(每个观看端单独限流)
+序号在每个观看端单独连续编号,丢帧不会引起对端重传请求
+写失败后写协程退出,之后的帧直接丢弃,由exit回调关闭连接
+*/
+type peerWriter struct {
+	videoTrack          rtpTrackWriter
+	audioTrack          rtpTrackWriter
+	queue               chan *rtpFrame
+	done                chan struct{}
+	exited              atomic.Bool
+	replay              []*rtpFrame
+	waitKeyFrame        bool
+	lastKeyFrameRequest time.Time
+	videoSeq            uint16
+	audioSeq            uint16
+	tsOffset            uint32
+}
+
+func newPeerWriter(videoTrack rtpTrackWriter, audioTrack rtpTrackWriter) *peerWriter {
+	return &peerWriter{
+		videoTrack: videoTrack,
+		audioTrack: audioTrack,
+		queue:      make(chan *rtpFrame, peerQueueSize),
+		done:       make(chan struct{}),
+		videoSeq:   uint16(rand.Uint32()),
+		audioSeq:   uint16(rand.Uint32()),
+	}
+}
+
+// 入队,返回false表示丢弃了视频帧需要关键帧,只在采集线程调用
+func (writer *peerWriter) push(frame *rtpFrame) bool {
+	if writer.exited.Load() {
+		return true
+	}
+	if !frame.audio {
+		if writer.waitKeyFrame && !frame.keyFrame {
+			return true
+		}
+		writer.waitKeyFrame = false
+	}
+	select {
+	case writer.queue <- frame:
+		return true
+	default:
+		if frame.audio {
+			return true
+		}
+		writer.waitKeyFrame = true
+		//慢的观看端每个关键帧都可能放不进队列,限流后不会一直请求
+		if time.Since(writer.lastKeyFrameRequest) < peerKeyFrameWait {
+			return true
+		}
+		writer.lastKeyFrameRequest = time.Now()
+		return false
+	}
+}
+
+// 写协程,写失败时调用exit,close结束时不调用
+func (writer *peerWriter) loop(exit func()) {
+	if writer.run() != nil {
+		writer.exited.Store(true)
+		exit()
+	}
+}
+
+func (writer *peerWriter) run() error {
+	//先补发GOP缓存,时间戳压缩到最后一帧之前,之后的实时帧时间戳不变
+	count := len(writer.replay)
+	for i, frame := range writer.replay {
+		last := writer.replay[count-1].packets[0].Timestamp
+		writer.tsOffset = last - uint32(count-1-i)*gopReplayFrameTs - frame.packets[0].Timestamp
+		if err := writer.writeFrame(frame); err != nil {
+			return err
+		}
+	}
+	writer.replay = nil
+	writer.tsOffset = 0
+	for {
+		select {
+		case <-writer.done:
+			return nil
+		case frame := <-writer.queue:
+			if err := writer.writeFrame(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (writer *peerWriter) writeFrame(frame *rtpFrame) error {
+	for _, packet := range frame.packets {
+		out := *packet
+		if frame.audio {
+			out.SequenceNumber = writer.audioSeq
+			writer.audioSeq++
+			if err := writer.audioTrack.WriteRTP(&out); err != nil {
+				return err
+			}
+			continue
+		}
+		out.SequenceNumber = writer.videoSeq
+		out.Timestamp += writer.tsOffset
+		writer.videoSeq++
+		if err := writer.videoTrack.WriteRTP(&out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (writer *peerWriter) close() {
+	close(writer.done)
+}
+
+// 打包一次,所有观看端共用,调用时持有videoMu
+func (webrtcServer *WebrtcServer) packetizeVideo(sample *Sample) *rtpFrame {
+	if webrtcServer.videoPacketizer == nil {
+		return nil
+	}
+	//关键帧前带上参数集,中途加入的观看端也能解码
+	packets := webrtcServer.videoPacketizer.Packetize(sample.AnnexB(true), 0)
+	if len(packets) == 0 {
+		return nil
+	}
+	for _, packet := range packets {
+		packet.Timestamp = uint32(sample.Timestamp * 90 / 1000)
+	}
+	return &rtpFrame{keyFrame: sample.KeyFrame, packets: packets}
+}
+
+// 帧分发给所有已经开始接收的观看端,视频帧调用时持有videoMu,音频帧持有audioMu
+func (webrtcServer *WebrtcServer) writePeers(frame *rtpFrame) {
+	webrtcServer.peerMu.Lock()
+	writers := make([]*peerWriter, 0, len(webrtcServer.peers))
+	for _, peer := range webrtcServer.peers {
+		if peer.writer != nil {
+			writers = append(writers, peer.writer)
+		}
+	}
+	webrtcServer.peerMu.Unlock()
+	for _, writer := range writers {
+		//请求关键帧的回调可能阻塞(给编码端发控制消息),不放在采集线程
+		if !writer.push(frame) {
+			go webrtcServer.RequestKeyFrame()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package comm
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// 模拟观看端的轨道,每个包写入前暂停delay,fail时直接返回错误
+type testTrack struct {
+	delay   time.Duration
+	fail    bool
+	packets atomic.Int64
+}
+
+func (track *testTrack) WriteRTP(packet *rtp.Packet) error {
+	if track.fail {
+		return errors.New("closed")
+	}
+	time.Sleep(track.delay)
+	track.packets.Add(1)
+	return nil
+}
+
+func newTestServer(t testing.TB, requests *atomic.Int64) *WebrtcServer {
+	webrtcServer, err := NewWebRtc(webrtc.MimeTypeH264)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//全局不限流,只看每个观看端自己的限流
+	webrtcServer.SetConfig(&Config{KeyFrameInterval: 1})
+	webrtcServer.SetKeyFrameRequestFun(func() {
+		requests.Add(1)
+	})
+	return webrtcServer
+}
+
+func addTestPeer(t testing.TB, webrtcServer *WebrtcServer, session string, track *testTrack) *viewerPeer {
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &viewerPeer{session: session, peerConnection: peerConnection, connected: true}
+	peer.writer = newPeerWriter(track, track)
+	webrtcServer.peerMu.Lock()
+	webrtcServer.peers[session] = peer
+	webrtcServer.peerConnectionCount++
+	webrtcServer.peerMu.Unlock()
+	go peer.writer.loop(func() {
+		webrtcServer.closePeer(peer)
+	})
+	return peer
+}
+
+func testFrame(i int) *rtpFrame {
+	packets := make([]*rtp.Packet, 4)
+	for j := range packets {
+		packets[j] = &rtp.Packet{Header: rtp.Header{Timestamp: uint32(i * 1500), Marker: j == len(packets)-1}, Payload: make([]byte, 1000)}
+	}
+	return &rtpFrame{keyFrame: i%60 == 0, packets: packets}
+}
+
+// 慢观看端不能拖慢采集线程,也不能每个关键帧都请求关键帧
+func TestSlowPeerNoBlockNoKeyFrameStorm(t *testing.T) {
+	var requests atomic.Int64
+	webrtcServer := newTestServer(t, &requests)
+	fast := &testTrack{}
+	slow := &testTrack{delay: 50 * time.Millisecond}
+	addTestPeer(t, webrtcServer, "fast", fast)
+	addTestPeer(t, webrtcServer, "slow", slow)
+	defer webrtcServer.ClosePeers()
+
+	const frames = 3000
+	var worst time.Duration
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		begin := time.Now()
+		webrtcServer.writePeers(testFrame(i))
+		if cost := time.Since(begin); cost > worst {
+			worst = cost
+		}
+		//快的观看端每帧都能写完
+		if i%100 == 99 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	elapsed := time.Since(start)
+	time.Sleep(50 * time.Millisecond)
+	if worst > 20*time.Millisecond {
+		t.Fatalf("ingest blocked %v", worst)
+	}
+	//慢观看端在整个过程中队列一直是满的,每个关键帧都放不进去
+	limit := int64(elapsed/time.Second) + 1
+	if got := requests.Load(); got < 1 || got > limit {
+		t.Fatalf("keyframe requests %d, want 1..%d in %v", got, limit, elapsed)
+	}
+	if fast.packets.Load() == 0 {
+		t.Fatal("fast peer got nothing")
+	}
+}
+
+// 写失败的观看端要被关闭,之后的帧不再入队也不再请求关键帧
+func TestFailedPeerDetached(t *testing.T) {
+	var requests atomic.Int64
+	webrtcServer := newTestServer(t, &requests)
+	peer := addTestPeer(t, webrtcServer, "dead", &testTrack{fail: true})
+	webrtcServer.writePeers(testFrame(0))
+	deadline := time.Now().Add(2 * time.Second)
+	for webrtcServer.PeerCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if webrtcServer.PeerCount() != 0 {
+		t.Fatal("dead peer still attached")
+	}
+	webrtcServer.peerMu.Lock()
+	attached := peer.writer != nil
+	webrtcServer.peerMu.Unlock()
+	if attached {
+		t.Fatal("writer not detached")
+	}
+	before := requests.Load()
+	for i := 1; i < 1000; i++ {
+		webrtcServer.writePeers(testFrame(i))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if requests.Load() != before {
+		t.Fatalf("keyframe requests after close %d", requests.Load()-before)
+	}
+}
+
+// 一个慢观看端加若干正常观看端时每帧分发的耗时
+func BenchmarkWritePeersSlowPeer(b *testing.B) {
+	var requests atomic.Int64
+	webrtcServer := newTestServer(b, &requests)
+	addTestPeer(b, webrtcServer, "slow", &testTrack{delay: 10 * time.Millisecond})
+	for i := 0; i < 8; i++ {
+		addTestPeer(b, webrtcServer, string(rune('a'+i)), &testTrack{})
+	}
+	defer webrtcServer.ClosePeers()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		webrtcServer.writePeers(testFrame(i))
+	}
+	b.ReportMetric(float64(requests.Load()), "keyframe-requests")
+}
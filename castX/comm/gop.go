@@ -0,0 +1,64 @@
+package comm
+
+import "fmt"
+
+const (
+	gopMaxFrames = 600
+	gopMaxBytes  = 16 * 1024 * 1024
+)
+
+/*
+缓存最近一个关键帧开始的所有视频帧(已经打包好的rtp),新观看端连上后先补发这些帧,不用等下一个关键帧
+超出上限时清空,等下一个关键帧重新缓存
+*/
+type gopCache struct {
+	frames   []*rtpFrame
+	size     int
+	overflow bool
+}
+
+func (cache *gopCache) push(frame *rtpFrame) {
+	if frame.keyFrame {
+		cache.frames = nil
+		cache.size = 0
+		cache.overflow = false
+	}
+	if cache.overflow || len(cache.frames) == 0 && !frame.keyFrame {
+		return
+	}
+	size := 0
+	for _, packet := range frame.packets {
+		size += len(packet.Payload)
+	}
+	if len(cache.frames) >= gopMaxFrames || cache.size+size > gopMaxBytes {
+		cache.reset()
+		cache.overflow = true
+		return
+	}
+	cache.frames = append(cache.frames, frame)
+	cache.size += size
+}
+
+func (cache *gopCache) reset() {
+	cache.frames = nil
+	cache.size = 0
+	cache.overflow = false
+}
+
+// 观看端连上后先补发缓存,之后再接收实时画面
+func (webrtcServer *WebrtcServer) startPeerVideo(peer *viewerPeer) {
+	webrtcServer.videoMu.Lock()
+	defer webrtcServer.videoMu.Unlock()
+	webrtcServer.peerMu.Lock()
+	defer webrtcServer.peerMu.Unlock()
+	if peer.closed || peer.writer != nil {
+		return
+	}
+	writer := newPeerWriter(peer.videoTrack, peer.audioTrack)
+	writer.replay = append([]*rtpFrame(nil), webrtcServer.gop.frames...)
+	peer.writer = writer
+	go writer.loop(func() {
+		fmt.Printf("peer %s write err\r\n", peer.session)
+		webrtcServer.closePeer(peer)
+	})
+}
@@ -0,0 +1,422 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	hlsIdleTimeout = 30 * time.Second //没有请求时停止打包
+)
+
+/*
+LL-HLS输出(RFC 8216bis),给大量只看不控制的观众用,所有观众共用一份分片
+分片和part都是fmp4(moof+mdat),只有视频,播放列表支持阻塞刷新和预加载提示
+第一次POST /hls鉴权后开始打包,返回带随机key的播放地址,长时间没有请求自动停止
+*/
+type hlsPart struct {
+	data        []byte
+	duration    float64 //秒
+	independent bool
+}
+
+type hlsSegment struct {
+	msn      int
+	parts    []*hlsPart
+	duration float64
+	complete bool
+}
+
+type hlsPackager struct {
+	config        *Config
+	webrtcServer  *WebrtcServer
+	mu            sync.Mutex
+	running       bool
+	key           string
+	lastAccess    time.Time
+	stop          chan struct{}
+	changed       chan struct{} //有新的part时关闭并重建,唤醒阻塞的请求
+	muxer         *fmp4Muxer
+	init          []byte
+	segments      []*hlsSegment //保留的分片,最后一个可能还没结束
+	nextMsn       int
+	discontinuity int
+	partSamples   []*Sample
+	partDuration  float64
+	pending       *Sample //等下一帧确定时长
+}
+
+func newHlsPackager(config *Config, webrtcServer *WebrtcServer) *hlsPackager {
+	return &hlsPackager{config: config, webrtcServer: webrtcServer, changed: make(chan struct{})}
+}
+
+func (hls *hlsPackager) segmentTarget() float64 {
+	if hls.config.HlsSegmentDuration > 0 {
+		return float64(hls.config.HlsSegmentDuration) / 1000
+	}
+	return 2
+}
+
+func (hls *hlsPackager) partTarget() float64 {
+	if hls.config.HlsPartDuration > 0 {
+		return float64(hls.config.HlsPartDuration) / 1000
+	}
+	return 0.2
+}
+
+func (hls *hlsPackager) maxSegments() int {
+	if hls.config.HlsSegments > 0 {
+		return hls.config.HlsSegments
+	}
+	return 7
+}
+
+// 开始打包,已经在运行时只刷新访问时间,返回播放地址里的key
+func (hls *hlsPackager) start() string {
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+	hls.lastAccess = time.Now()
+	if hls.running {
+		return hls.key
+	}
+	hls.running = true
+	hls.key = randHex(8)
+	hls.stop = make(chan struct{})
+	hls.webrtcServer.AddSink(hls)
+	go hls.idleLoop(hls.stop)
+	go hls.webrtcServer.RequestKeyFrame()
+	return hls.key
+}
+
+func (hls *hlsPackager) idleLoop(stop chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		hls.mu.Lock()
+		idle := time.Since(hls.lastAccess) > hlsIdleTimeout
+		hls.mu.Unlock()
+		if idle {
+			hls.Stop()
+			return
+		}
+	}
+}
+
+func (hls *hlsPackager) Stop() {
+	hls.mu.Lock()
+	if !hls.running {
+		hls.mu.Unlock()
+		return
+	}
+	hls.running = false
+	hls.key = ""
+	close(hls.stop)
+	hls.mu.Unlock()
+	//RemoveSink会等队列写完,不能持有锁
+	hls.webrtcServer.RemoveSink(hls)
+	hls.mu.Lock()
+	hls.reset()
+	hls.segments = nil
+	hls.mu.Unlock()
+}
+
+// 丢弃正在打包的数据,下一个关键帧重新开始,播放列表里加不连续标记
+func (hls *hlsPackager) reset() {
+	hls.muxer = nil
+	hls.init = nil
+	hls.partSamples = nil
+	hls.partDuration = 0
+	hls.pending = nil
+	if len(hls.segments) > 0 {
+		hls.discontinuity++
+		hls.segments = nil
+	}
+	hls.notify()
+}
+
+func (hls *hlsPackager) notify() {
+	close(hls.changed)
+	hls.changed = make(chan struct{})
+}
+
+func (hls *hlsPackager) WriteSample(sample *Sample) {
+	if sample.Audio {
+		return
+	}
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+	if sample.KeyFrame && (hls.muxer == nil || !sameParams(hls.muxer.params, sample.Params)) {
+		hls.reset()
+		width, height := videoSize(hls.config, sample)
+		muxer, err := newFmp4Muxer(sample, width, height, false, nil)
+		if err != nil {
+			fmt.Printf("hls err:%+v\r\n", err)
+			return
+		}
+		hls.muxer = muxer
+		hls.init = muxer.initSegment()
+		hls.newSegment()
+	}
+	if hls.muxer == nil {
+		return
+	}
+	if pending := hls.pending; pending != nil {
+		duration := float64(sample.Timestamp-pending.Timestamp) / 1000000
+		if duration <= 0 {
+			duration = 1.0 / 30
+		}
+		if len(hls.partSamples) > 0 && hls.partDuration+duration > hls.partTarget() {
+			hls.closePart(pending.Timestamp)
+		}
+		hls.partSamples = append(hls.partSamples, pending)
+		hls.partDuration += duration
+	}
+	current := hls.segments[len(hls.segments)-1]
+	if current.duration+hls.partDuration >= hls.segmentTarget() {
+		if sample.KeyFrame {
+			hls.closePart(sample.Timestamp)
+			current.complete = true
+			hls.newSegment()
+			hls.notify()
+		} else {
+			//分片太长,请求关键帧尽快切分
+			go hls.webrtcServer.RequestKeyFrame()
+		}
+	}
+	hls.pending = sample
+}
+
+// 设备断开,丢弃未完成的数据
+func (hls *hlsPackager) StreamEnd() {
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+	hls.reset()
+}
+
+func (hls *hlsPackager) newSegment() {
+	hls.segments = append(hls.segments, &hlsSegment{msn: hls.nextMsn})
+	hls.nextMsn++
+	if len(hls.segments) > hls.maxSegments()+1 {
+		hls.segments = hls.segments[len(hls.segments)-hls.maxSegments()-1:]
+	}
+}
+
+func (hls *hlsPackager) closePart(videoEnd int64) {
+	if len(hls.partSamples) == 0 {
+		return
+	}
+	part := &hlsPart{
+		data:        hls.muxer.fragment(hls.partSamples, videoEnd, nil),
+		duration:    hls.partDuration,
+		independent: hls.partSamples[0].KeyFrame,
+	}
+	current := hls.segments[len(hls.segments)-1]
+	current.parts = append(current.parts, part)
+	current.duration += part.duration
+	hls.partSamples = nil
+	hls.partDuration = 0
+	hls.notify()
+}
+
+func (hls *hlsPackager) findSegment(msn int) *hlsSegment {
+	for _, segment := range hls.segments {
+		if segment.msn == msn {
+			return segment
+		}
+	}
+	return nil
+}
+
+// msn分片(part>=0时为其中的part)是否已经生成
+func (hls *hlsPackager) ready(msn int, part int) bool {
+	if hls.muxer == nil || len(hls.segments) == 0 {
+		return false
+	}
+	last := hls.segments[len(hls.segments)-1]
+	if msn < last.msn {
+		return true
+	}
+	if msn > last.msn {
+		return false
+	}
+	return part >= 0 && part < len(last.parts)
+}
+
+// 阻塞等待msn/part生成,超时返回false,调用时持有锁
+func (hls *hlsPackager) wait(r *http.Request, msn int, part int) bool {
+	timeout := time.After(time.Duration(hls.segmentTarget()*3*1000) * time.Millisecond)
+	for !hls.ready(msn, part) {
+		changed := hls.changed
+		hls.mu.Unlock()
+		select {
+		case <-changed:
+			hls.mu.Lock()
+		case <-timeout:
+			hls.mu.Lock()
+			return false
+		case <-r.Context().Done():
+			hls.mu.Lock()
+			return false
+		}
+		if !hls.running {
+			return false
+		}
+	}
+	return true
+}
+
+func (hls *hlsPackager) playlist() string {
+	partTarget := hls.partTarget()
+	//EXTINF四舍五入后不超过TARGETDURATION即可,避免刷新时来回变化
+	targetDuration := math.Ceil(hls.segmentTarget())
+	for _, segment := range hls.segments {
+		targetDuration = math.Max(targetDuration, math.Round(segment.duration))
+	}
+	var sb bytes.Buffer
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&sb, "#EXT-X-TARGETDURATION:%d\n", int(targetDuration))
+	fmt.Fprintf(&sb, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", partTarget*3)
+	fmt.Fprintf(&sb, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&sb, "#EXT-X-MEDIA-SEQUENCE:%d\n", hls.segments[0].msn)
+	fmt.Fprintf(&sb, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", hls.discontinuity)
+	//参数变化后init会换,按不连续序号区分,避免播放器用缓存的旧init
+	fmt.Fprintf(&sb, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", hls.discontinuity)
+	//只给最近的几个分片列出part
+	partsFrom := len(hls.segments) - 3
+	for i, segment := range hls.segments {
+		if i >= partsFrom {
+			for j, part := range segment.parts {
+				fmt.Fprintf(&sb, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s\"", part.duration, segment.msn, j)
+				if part.independent {
+					sb.WriteString(",INDEPENDENT=YES")
+				}
+				sb.WriteString("\n")
+			}
+		}
+		if segment.complete {
+			fmt.Fprintf(&sb, "#EXTINF:%.5f,\nseg%d.m4s\n", segment.duration, segment.msn)
+		}
+	}
+	last := hls.segments[len(hls.segments)-1]
+	fmt.Fprintf(&sb, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", last.msn, len(last.parts))
+	return sb.String()
+}
+
+/*
+POST /hls 或 /api/devices/{id}/hls
+鉴权和WHEP一致,返回{"url":"/hls/{key}/index.m3u8"},观众用这个地址播放
+*/
+func (wsServer *WsServer) handleHlsStart(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkBearerAuth(w, r) {
+		return
+	}
+	key := wsServer.hls.start()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"url": "/hls/" + key + "/index.m3u8"})
+}
+
+// GET /hls/{key}/{file} 播放列表和分片,不需要token,key在停止打包后失效
+func (wsServer *WsServer) handleHls(w http.ResponseWriter, r *http.Request) {
+	if isPrivateIPv4(r.RemoteAddr) == false {
+		http.Error(w, "Access denied. Only IPv4 LAN allowed.", http.StatusForbidden)
+		return
+	}
+	contentType, data, status := wsServer.hls.serve(r)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", contentType)
+	if contentType != "video/mp4" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	//分片数据生成后不会再修改,解锁后再写给慢的观众
+	for _, chunk := range data {
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+// 在锁里准备好响应内容
+func (hls *hlsPackager) serve(r *http.Request) (string, [][]byte, int) {
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+	if !hls.running || r.PathValue("key") != hls.key {
+		return "", nil, http.StatusNotFound
+	}
+	hls.lastAccess = time.Now()
+	file := r.PathValue("file")
+	var msn, part, version int
+	switch {
+	case file == "index.m3u8":
+		query := r.URL.Query()
+		if msnStr := query.Get("_HLS_msn"); len(msnStr) > 0 {
+			msn, err := strconv.Atoi(msnStr)
+			if err != nil {
+				return "", nil, http.StatusBadRequest
+			}
+			part := -1
+			if partStr := query.Get("_HLS_part"); len(partStr) > 0 {
+				if part, err = strconv.Atoi(partStr); err != nil {
+					return "", nil, http.StatusBadRequest
+				}
+			}
+			if msn > hls.nextMsn+1 {
+				return "", nil, http.StatusBadRequest
+			}
+			hls.wait(r, msn, part)
+		} else if hls.muxer == nil {
+			//刚开始打包,等第一个关键帧
+			hls.wait(r, hls.nextMsn-1, 0)
+		}
+		if !hls.running || len(hls.segments) == 0 || hls.muxer == nil {
+			return "", nil, http.StatusServiceUnavailable
+		}
+		return "application/vnd.apple.mpegurl", [][]byte{[]byte(hls.playlist())}, http.StatusOK
+	case parseHlsName(file, "init%d.mp4", &version):
+		if version == hls.discontinuity && hls.init == nil && !hls.wait(r, hls.nextMsn-1, 0) {
+			return "", nil, http.StatusServiceUnavailable
+		}
+		if version != hls.discontinuity || hls.init == nil {
+			return "", nil, http.StatusNotFound
+		}
+		return "video/mp4", [][]byte{hls.init}, http.StatusOK
+	case parseHlsName(file, "seg%d.m4s", &msn):
+		segment := hls.findSegment(msn)
+		if segment == nil || !segment.complete {
+			return "", nil, http.StatusNotFound
+		}
+		var data [][]byte
+		for _, part := range segment.parts {
+			data = append(data, part.data)
+		}
+		return "video/mp4", data, http.StatusOK
+	case parseHlsName(file, "part%d.%d.m4s", &msn, &part):
+		//预加载提示的part还没生成时阻塞等待
+		if msn >= hls.nextMsn-1 && !hls.wait(r, msn, part) {
+			return "", nil, http.StatusServiceUnavailable
+		}
+		segment := hls.findSegment(msn)
+		if segment == nil || part < 0 || part >= len(segment.parts) {
+			return "", nil, http.StatusNotFound
+		}
+		return "video/mp4", [][]byte{segment.parts[part].data}, http.StatusOK
+	}
+	return "", nil, http.StatusNotFound
+}
+
+func parseHlsName(name string, format string, values ...interface{}) bool {
+	n, err := fmt.Sscanf(name, format, values...)
+	return err == nil && n == len(values)
+}
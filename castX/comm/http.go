@@ -1,9 +1,11 @@
 package comm
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/dosgo/castX/static"
 )
@@ -17,6 +19,35 @@ func StartWeb(port int, wsServer *WsServer) (*HttpServer, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", wsServer.handleWebSocket)
 	mux.HandleFunc("/usbWs", wsServer.handleWebSocket)
+	mux.HandleFunc("GET /api/devices/{id}/logcat", wsServer.handleLogcat)
+	mux.HandleFunc("GET /api/devices/{id}/screenshot.png", wsServer.handleScreenshot)
+	mux.HandleFunc("POST /api/devices/{id}/record/{action}", wsServer.handleRecord)
+	mux.HandleFunc("POST /api/devices/{id}/replay/save", wsServer.handleSaveReplay)
+	mux.HandleFunc("GET /api/recordings", wsServer.handleRecordingList)
+	mux.HandleFunc("GET /api/recordings/{name}", wsServer.handleRecordingDownload)
+	mux.HandleFunc("POST /whep", wsServer.handleWhep)
+	mux.HandleFunc("OPTIONS /whep", wsServer.handleWhepOptions)
+	mux.HandleFunc("DELETE /whep/{session}", wsServer.handleWhepDelete)
+	mux.HandleFunc("POST /api/devices/{id}/whep", wsServer.handleWhep)
+	mux.HandleFunc("OPTIONS /api/devices/{id}/whep", wsServer.handleWhepOptions)
+	mux.HandleFunc("DELETE /api/devices/{id}/whep/{session}", wsServer.handleWhepDelete)
+	mux.HandleFunc("POST /whip", wsServer.handleWhip)
+	mux.HandleFunc("OPTIONS /whip", wsServer.handleWhepOptions)
+	mux.HandleFunc("DELETE /whip/{session}", wsServer.handleWhipDelete)
+	mux.HandleFunc("POST /api/devices/{id}/whip", wsServer.handleWhip)
+	mux.HandleFunc("OPTIONS /api/devices/{id}/whip", wsServer.handleWhepOptions)
+	mux.HandleFunc("DELETE /api/devices/{id}/whip/{session}", wsServer.handleWhipDelete)
+	mux.HandleFunc("GET /stream", wsServer.handleStream)
+	mux.HandleFunc("GET /api/devices/{id}/stream", wsServer.handleStream)
+	mux.HandleFunc("GET /stream.ts", wsServer.handleTs)
+	mux.HandleFunc("GET /api/devices/{id}/stream.ts", wsServer.handleTs)
+	mux.HandleFunc("GET /raw", wsServer.handleRaw)
+	mux.HandleFunc("GET /api/devices/{id}/raw", wsServer.handleRaw)
+	mux.HandleFunc("POST /hls", wsServer.handleHlsStart)
+	mux.HandleFunc("POST /api/devices/{id}/hls", wsServer.handleHlsStart)
+	mux.HandleFunc("GET /hls/{key}/{file}", wsServer.handleHls)
+	mux.HandleFunc("GET /api/devices/{id}/rtmp", wsServer.handleRtmp)
+	mux.HandleFunc("POST /api/devices/{id}/rtmp/{action}", wsServer.handleRtmp)
 	mux.Handle("/", http.FileServer(http.FS(static.StaticFiles)))
 	httpServer.server = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
 	fmt.Printf("StartWeb port:%d\r\n", port)
@@ -32,6 +63,41 @@ func (httpServer *HttpServer) Shutdown() {
 	}
 }
 
+/*
+http接口鉴权,和websocket登录使用相同的token算法
+token和timestamp可以放在query参数或者X-Castx-Token/X-Castx-Timestamp头里
+*/
+func (wsServer *WsServer) checkHttpAuth(w http.ResponseWriter, r *http.Request) bool {
+	if isPrivateIPv4(r.RemoteAddr) == false {
+		http.Error(w, "Access denied. Only IPv4 LAN allowed.", http.StatusForbidden)
+		return false
+	}
+	reqToken := r.URL.Query().Get("token")
+	if reqToken == "" {
+		reqToken = r.Header.Get("X-Castx-Token")
+	}
+	timestampStr := r.URL.Query().Get("timestamp")
+	if timestampStr == "" {
+		timestampStr = r.Header.Get("X-Castx-Timestamp")
+	}
+	timestamp, _ := strconv.ParseFloat(timestampStr, 64)
+	if !wsServer.verifyToken(reqToken, timestamp) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if id := r.PathValue("id"); id != "" && !wsServer.config.MatchDevice(id) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
 func isPrivateIPv4(ipAddr string) bool {
 	ipStr, _, err := net.SplitHostPort(ipAddr)
 	if err != nil {
@@ -0,0 +1,297 @@
+package comm
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/wlynxg/anet"
+)
+
+/*
+内置turn中继,访客网络、vpn等无法直连的观看端通过它中转
+使用turn REST方式的临时账号,没有配置TurnSecret时启动时随机生成
+*/
+type TurnServer struct {
+	server *turn.Server
+}
+
+func StartTurn(config *Config) (*TurnServer, error) {
+	if len(config.TurnRealm) == 0 {
+		config.TurnRealm = "castx"
+	}
+	if len(config.TurnSecret) == 0 {
+		config.TurnSecret = randHex(16)
+	}
+	if len(config.TurnPublicIP) == 0 {
+		config.TurnPublicIP = localIPv4()
+	}
+	relayIP := net.ParseIP(config.TurnPublicIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("invalid turn public ip:%s", config.TurnPublicIP)
+	}
+	udpListener, err := net.ListenPacket("udp4", config.TurnListen)
+	if err != nil {
+		return nil, err
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       config.TurnRealm,
+		AuthHandler: turn.NewLongTermAuthHandler(config.TurnSecret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{RelayAddress: relayIP, Address: "0.0.0.0"},
+		}},
+	})
+	if err != nil {
+		udpListener.Close()
+		return nil, err
+	}
+	fmt.Printf("StartTurn listen:%s relay:%s\r\n", config.TurnListen, config.TurnPublicIP)
+	return &TurnServer{server: server}, nil
+}
+
+func (turnServer *TurnServer) Close() error {
+	return turnServer.server.Close()
+}
+
+/*
+下发给观看端的ice服务器列表
+配置了TurnSecret时,没有账号的turn地址生成临时账号;启动了内置turn时自动加上它的地址
+*/
+func (config *Config) IceServerList() []IceServer {
+	var servers []IceServer
+	var username, credential string
+	if len(config.TurnSecret) > 0 {
+		ttl := config.TurnTTL
+		if ttl <= 0 {
+			ttl = 86400
+		}
+		username, credential, _ = turn.GenerateLongTermCredentials(config.TurnSecret, time.Duration(ttl)*time.Second)
+	}
+	for _, server := range config.IceServers {
+		if len(server.Username) == 0 && len(username) > 0 && isTurnServer(server) {
+			server.Username = username
+			server.Credential = credential
+		}
+		servers = append(servers, server)
+	}
+	if len(config.TurnListen) > 0 && len(config.TurnPublicIP) > 0 {
+		_, port, err := net.SplitHostPort(config.TurnListen)
+		if err == nil {
+			url := "turn:" + net.JoinHostPort(config.TurnPublicIP, port) + "?transport=udp"
+			servers = append(servers, IceServer{URLs: []string{url}, Username: username, Credential: credential})
+		}
+	}
+	return servers
+}
+
+// pion使用的ice服务器配置
+func (config *Config) WebrtcConfiguration() webrtc.Configuration {
+	return webrtc.Configuration{ICEServers: toWebrtcIceServers(config.IceServerList())}
+}
+
+func toWebrtcIceServers(servers []IceServer) []webrtc.ICEServer {
+	var iceServers []webrtc.ICEServer
+	for _, server := range servers {
+		iceServer := webrtc.ICEServer{URLs: server.URLs}
+		if len(server.Username) > 0 {
+			iceServer.Username = server.Username
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		iceServers = append(iceServers, iceServer)
+	}
+	return iceServers
+}
+
+func isTurnServer(server IceServer) bool {
+	for _, url := range server.URLs {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			return true
+		}
+	}
+	return false
+}
+
+// 本机第一个局域网ipv4地址
+func localIPv4() string {
+	addrs, err := anet.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			if ipNet.IP.IsPrivate() {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return ""
+}
+
+// 解析"stun:host:port,turn:host:port|user|pass"格式的ice服务器配置,方便命令行和安卓传参
+func ParseIceServers(value string) []IceServer {
+	var servers []IceServer
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.Split(item, "|")
+		server := IceServer{URLs: []string{parts[0]}}
+		if len(parts) >= 3 {
+			server.Username = parts[1]
+			server.Credential = parts[2]
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+/*
+pion的SettingEngine和共用的ice端口,所有PeerConnection共用一份,端口只监听一次
+*/
+type IceTransport struct {
+	settingEngine webrtc.SettingEngine
+	udpMux        ice.UDPMux
+	tcpListener   net.Listener
+	tcpMux        ice.TCPMux
+}
+
+func NewIceTransport(config *Config) (*IceTransport, error) {
+	transport := &IceTransport{}
+	settingEngine := &transport.settingEngine
+	interfaceFilter := config.iceInterfaceFilter()
+	ipFilter := config.iceIPFilter()
+	if interfaceFilter != nil {
+		settingEngine.SetInterfaceFilter(interfaceFilter)
+	}
+	if ipFilter != nil {
+		settingEngine.SetIPFilter(ipFilter)
+	}
+	if len(config.NAT1To1IPs) > 0 {
+		settingEngine.SetNAT1To1IPs(config.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	if config.EphemeralPortMin > 0 && config.EphemeralPortMax >= config.EphemeralPortMin {
+		if err := settingEngine.SetEphemeralUDPPortRange(config.EphemeralPortMin, config.EphemeralPortMax); err != nil {
+			return nil, err
+		}
+	}
+	if config.IceUdpPort > 0 {
+		var opts []ice.UDPMuxFromPortOption
+		if interfaceFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(interfaceFilter))
+		}
+		if ipFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithIPFilter(ipFilter))
+		}
+		udpMux, err := ice.NewMultiUDPMuxFromPort(config.IceUdpPort, opts...)
+		if err != nil {
+			//安卓上可能拿不到网卡列表,退回到监听所有地址
+			udpConn, listenErr := net.ListenUDP("udp4", &net.UDPAddr{Port: config.IceUdpPort})
+			if listenErr != nil {
+				return nil, listenErr
+			}
+			transport.udpMux = webrtc.NewICEUDPMux(nil, udpConn)
+		} else {
+			transport.udpMux = udpMux
+		}
+		settingEngine.SetICEUDPMux(transport.udpMux)
+	}
+	if config.IceTcpPort > 0 {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{Port: config.IceTcpPort})
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+		transport.tcpListener = listener
+		transport.tcpMux = webrtc.NewICETCPMux(nil, listener, 8)
+		settingEngine.SetICETCPMux(transport.tcpMux)
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6,
+		})
+	}
+	return transport, nil
+}
+
+// 用共用的SettingEngine创建API,mediaEngine为空时使用默认编码
+func (transport *IceTransport) NewAPI(mediaEngine *webrtc.MediaEngine) (*webrtc.API, error) {
+	return transport.newAPI(mediaEngine, nil)
+}
+
+// configure为空时注册pion默认的拦截器,否则由configure注册全部拦截器
+func (transport *IceTransport) newAPI(mediaEngine *webrtc.MediaEngine, configure func(*webrtc.MediaEngine, *interceptor.Registry) error) (*webrtc.API, error) {
+	if mediaEngine == nil {
+		mediaEngine = &webrtc.MediaEngine{}
+		if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+			return nil, err
+		}
+	}
+	registry := &interceptor.Registry{}
+	if configure == nil {
+		configure = webrtc.RegisterDefaultInterceptors
+	}
+	if err := configure(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	var settingEngine webrtc.SettingEngine
+	if transport != nil {
+		settingEngine = transport.settingEngine
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry), webrtc.WithSettingEngine(settingEngine)), nil
+}
+
+func (transport *IceTransport) Close() {
+	if transport.udpMux != nil {
+		transport.udpMux.Close()
+	}
+	if transport.tcpMux != nil {
+		transport.tcpMux.Close()
+	}
+	if transport.tcpListener != nil {
+		transport.tcpListener.Close()
+	}
+}
+
+func (config *Config) iceInterfaceFilter() func(string) bool {
+	if len(config.IceInterfaces) == 0 {
+		return nil
+	}
+	names := append([]string(nil), config.IceInterfaces...)
+	return func(name string) bool {
+		return slices.Contains(names, name)
+	}
+}
+
+func (config *Config) iceIPFilter() func(net.IP) bool {
+	if len(config.IceIPs) == 0 {
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, value := range config.IceIPs {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(value); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return func(ip net.IP) bool {
+		for _, ipNet := range nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,107 @@
+package comm
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	defaultJitterLatency = 100 * time.Millisecond
+	jitterMaxPackets     = 1024 //缓存包数上限,超过时不再等待缺的包
+	jitterResetDistance  = 3000 //序号跳变超过这个值认为对端重新开始
+)
+
+type jitterPacket struct {
+	packet  *rtp.Packet
+	arrival time.Time
+}
+
+// 按rtp序号重排的抖动缓冲,缺包时最多等待latency,超时判定丢失
+// 只在push/pop时检查超时,调用方按deadline定时pop,不用等下一个包到达
+type jitterBuffer struct {
+	latency time.Duration
+	packets map[uint16]jitterPacket
+	next    uint16 //下一个要输出的序号
+	started bool
+}
+
+func newJitterBuffer(latency time.Duration) *jitterBuffer {
+	if latency <= 0 {
+		latency = defaultJitterLatency
+	}
+	return &jitterBuffer{latency: latency, packets: map[uint16]jitterPacket{}}
+}
+
+func (jb *jitterBuffer) push(packet *rtp.Packet, now time.Time) {
+	seq := packet.SequenceNumber
+	if !jb.started {
+		jb.started = true
+		jb.next = seq
+	}
+	diff := int16(seq - jb.next)
+	if diff < 0 {
+		//已经输出过或者判定丢失后才到的包
+		if -int(diff) < jitterResetDistance {
+			return
+		}
+		jb.reset(seq)
+	} else if int(diff) >= jitterResetDistance {
+		jb.reset(seq)
+	}
+	if _, ok := jb.packets[seq]; ok {
+		return
+	}
+	jb.packets[seq] = jitterPacket{packet: packet, arrival: now}
+}
+
+// 从头重新计序号,缓存的包全部丢弃
+func (jb *jitterBuffer) reset(seq uint16) {
+	jb.packets = map[uint16]jitterPacket{}
+	jb.next = seq
+}
+
+// 取出下一个按序的包,lost表示它前面有包被判定丢失,没有可输出的包时返回nil
+func (jb *jitterBuffer) pop(now time.Time) (packet *rtp.Packet, lost bool) {
+	if len(jb.packets) == 0 {
+		return nil, false
+	}
+	if item, ok := jb.packets[jb.next]; ok {
+		delete(jb.packets, jb.next)
+		jb.next++
+		return item.packet, false
+	}
+	//缺包,最早到达的包等满latency或者缓存过多才跳过
+	first, oldest := jb.oldest()
+	if now.Sub(oldest) < jb.latency && len(jb.packets) < jitterMaxPackets {
+		return nil, false
+	}
+	item := jb.packets[first]
+	delete(jb.packets, first)
+	jb.next = first + 1
+	return item.packet, true
+}
+
+// 缓存里序号最小的包和最早的到达时间,缓存不能为空
+func (jb *jitterBuffer) oldest() (first uint16, oldest time.Time) {
+	found := false
+	for seq, item := range jb.packets {
+		if !found || int16(seq-first) < 0 {
+			first = seq
+		}
+		if !found || item.arrival.Before(oldest) {
+			oldest = item.arrival
+		}
+		found = true
+	}
+	return first, oldest
+}
+
+// 还在等缺的包时返回放弃等待的时间,pop到没有输出后调用
+func (jb *jitterBuffer) deadline() (time.Time, bool) {
+	if len(jb.packets) == 0 {
+		return time.Time{}, false
+	}
+	_, oldest := jb.oldest()
+	return oldest.Add(jb.latency), true
+}
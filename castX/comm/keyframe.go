@@ -0,0 +1,58 @@
+package comm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+观看端丢包或者中途加入时会发PLI/FIR请求关键帧,转给编码端(scrcpy重置编码器等)
+限制请求频率,避免某个观看端反复请求导致编码端一直出关键帧
+返回之前的回调,临时接管(中继、WHIP推流)结束后用它恢复
+*/
+func (webrtcServer *WebrtcServer) SetKeyFrameRequestFun(keyFrameRequestCall func()) func() {
+	webrtcServer.keyFrameMu.Lock()
+	defer webrtcServer.keyFrameMu.Unlock()
+	previous := webrtcServer.keyFrameRequestCall
+	webrtcServer.keyFrameRequestCall = keyFrameRequestCall
+	return previous
+}
+
+// 请求编码端输出关键帧,被限流或者没有设置回调时返回false
+func (webrtcServer *WebrtcServer) RequestKeyFrame() bool {
+	interval := time.Second
+	if webrtcServer.config != nil && webrtcServer.config.KeyFrameInterval > 0 {
+		interval = time.Duration(webrtcServer.config.KeyFrameInterval) * time.Millisecond
+	}
+	webrtcServer.keyFrameMu.Lock()
+	call := webrtcServer.keyFrameRequestCall
+	if call == nil || time.Since(webrtcServer.lastKeyFrameRequest) < interval {
+		webrtcServer.keyFrameMu.Unlock()
+		return false
+	}
+	webrtcServer.lastKeyFrameRequest = time.Now()
+	webrtcServer.keyFrameMu.Unlock()
+	call()
+	return true
+}
+
+// 读取观看端发来的rtcp,遇到PLI/FIR请求关键帧,连接关闭时退出
+func (webrtcServer *WebrtcServer) readRTCP(rtpSender *webrtc.RTPSender) {
+	for {
+		packets, _, err := rtpSender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if webrtcServer.RequestKeyFrame() {
+					fmt.Printf("keyframe request:%T\r\n", packet)
+				}
+			}
+		}
+	}
+}
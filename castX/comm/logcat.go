@@ -0,0 +1,392 @@
+package comm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// logcat 单条日志
+type LogEntry struct {
+	Time    string `json:"time"`
+	Pid     int    `json:"pid"`
+	Tid     int    `json:"tid"`
+	Level   string `json:"level"`
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+// threadtime格式: "10-19 12:34:56.789  1234  5678 I Tag     : message"
+var threadtimeRegexp = regexp.MustCompile(`^(\d\d-\d\d \d\d:\d\d:\d\d\.\d{3})\s+(\d+)\s+(\d+)\s+([VDIWEFAS])\s+(.*?)\s*: (.*)$`)
+
+// 解析threadtime格式的一行日志
+func ParseLogcatLine(line string) (*LogEntry, bool) {
+	m := threadtimeRegexp.FindStringSubmatch(strings.TrimRight(line, "\r"))
+	if m == nil {
+		return nil, false
+	}
+	pid, _ := strconv.Atoi(m[2])
+	tid, _ := strconv.Atoi(m[3])
+	return &LogEntry{Time: m[1], Pid: pid, Tid: tid, Level: m[4], Tag: m[5], Message: m[6]}, true
+}
+
+var logLevelOrder = map[string]int{"V": 0, "D": 1, "I": 2, "W": 3, "E": 4, "F": 5, "A": 6, "S": 7}
+
+// 包名会拼进shell命令,只允许这些字符
+var packageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+// 服务端过滤条件,空值表示不过滤
+type LogFilter struct {
+	Level   string //最低级别
+	Tags    map[string]bool
+	Package string         //包名,通过pidof转换成pid
+	Regexp  *regexp.Regexp //匹配tag或message
+	pids    map[int]bool
+}
+
+func NewLogFilter(level string, tags string, pkg string, expr string) (*LogFilter, error) {
+	filter := &LogFilter{Level: strings.ToUpper(level), Package: pkg}
+	if _, ok := logLevelOrder[filter.Level]; len(filter.Level) > 0 && !ok {
+		return nil, fmt.Errorf("unknown level %s", level)
+	}
+	if len(pkg) > 0 && !packageNameRegexp.MatchString(pkg) {
+		return nil, fmt.Errorf("invalid package %s", pkg)
+	}
+	if len(tags) > 0 {
+		filter.Tags = make(map[string]bool)
+		for _, tag := range strings.Split(tags, ",") {
+			filter.Tags[strings.TrimSpace(tag)] = true
+		}
+	}
+	if len(expr) > 0 {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		filter.Regexp = re
+	}
+	return filter, nil
+}
+
+func (filter *LogFilter) Match(entry *LogEntry) bool {
+	if len(filter.Level) > 0 && logLevelOrder[entry.Level] < logLevelOrder[filter.Level] {
+		return false
+	}
+	if filter.Tags != nil && !filter.Tags[entry.Tag] {
+		return false
+	}
+	if len(filter.Package) > 0 && !filter.pids[entry.Pid] {
+		return false
+	}
+	if filter.Regexp != nil && !filter.Regexp.MatchString(entry.Tag) && !filter.Regexp.MatchString(entry.Message) {
+		return false
+	}
+	return true
+}
+
+type logSubscriber struct {
+	filter *LogFilter
+	ch     chan *LogEntry
+}
+
+/*
+logcat转发
+libadb只有一次性的shell调用,没有可以持续读取的shell会话,所以这里每500ms按时间增量轮询 logcat -d -T 来模拟持续输出
+限制:两次轮询之间设备日志缓冲区被写满覆盖时,被覆盖的日志会丢失;输出有最多500ms的延迟
+*/
+type Logcat struct {
+	config      *Config
+	wsServer    *WsServer
+	subscribers map[*logSubscriber]bool
+	mu          sync.Mutex
+	run         bool
+	generation  int //每次启动轮询加1,旧的轮询协程发现不是当前代就退出
+	capture     bool
+	lastTime    string
+	lastLines   map[string]int //lastTime这一毫秒内每行已经输出过的次数,用于去重
+	pidTime     time.Time
+	file        *os.File
+	fileSize    int64
+}
+
+func NewLogcat(config *Config, wsServer *WsServer) *Logcat {
+	return &Logcat{
+		config:      config,
+		wsServer:    wsServer,
+		subscribers: make(map[*logSubscriber]bool),
+	}
+}
+
+// 开启落盘,需要配置LogcatDir
+func (logcat *Logcat) StartCapture() {
+	if len(logcat.config.LogcatDir) == 0 {
+		return
+	}
+	logcat.mu.Lock()
+	logcat.capture = true
+	logcat.mu.Unlock()
+	logcat.start()
+}
+
+func (logcat *Logcat) Subscribe(filter *LogFilter) *logSubscriber {
+	sub := &logSubscriber{filter: filter, ch: make(chan *LogEntry, 256)}
+	logcat.mu.Lock()
+	logcat.subscribers[sub] = true
+	logcat.mu.Unlock()
+	logcat.start()
+	return sub
+}
+
+func (logcat *Logcat) Unsubscribe(sub *logSubscriber) {
+	logcat.mu.Lock()
+	defer logcat.mu.Unlock()
+	if logcat.subscribers[sub] {
+		delete(logcat.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (logcat *Logcat) Stop() {
+	logcat.mu.Lock()
+	defer logcat.mu.Unlock()
+	logcat.run = false
+	logcat.capture = false
+	for sub := range logcat.subscribers {
+		delete(logcat.subscribers, sub)
+		close(sub.ch)
+	}
+	if logcat.file != nil {
+		logcat.file.Close()
+		logcat.file = nil
+	}
+}
+
+func (logcat *Logcat) start() {
+	logcat.mu.Lock()
+	defer logcat.mu.Unlock()
+	if logcat.run {
+		return
+	}
+	logcat.run = true
+	logcat.generation++
+	go logcat.pollLoop(logcat.generation)
+}
+
+// 没有订阅者也不落盘时停止,Stop之后或者已经有新的轮询协程时返回true,调用时持有mu
+func (logcat *Logcat) idle(generation int) bool {
+	if !logcat.run || generation != logcat.generation {
+		return true
+	}
+	if len(logcat.subscribers) == 0 && !logcat.capture {
+		logcat.run = false
+		return true
+	}
+	return false
+}
+
+func (logcat *Logcat) pollLoop(generation int) {
+	for {
+		logcat.mu.Lock()
+		if logcat.idle(generation) {
+			logcat.mu.Unlock()
+			return
+		}
+		lastTime := logcat.lastTime
+		logcat.mu.Unlock()
+		logcat.refreshPids()
+		cmd := "logcat -d -v threadtime -t 200"
+		if len(lastTime) > 0 {
+			cmd = fmt.Sprintf("logcat -d -v threadtime -T '%s'", lastTime)
+		}
+		out, err := logcat.wsServer.Shell(cmd)
+		if err == nil {
+			logcat.dispatch(generation, out)
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+}
+
+func (logcat *Logcat) dispatch(generation int, out string) {
+	logcat.mu.Lock()
+	defer logcat.mu.Unlock()
+	//Shell期间已经Stop或者换了新的轮询协程,结果丢弃
+	if logcat.idle(generation) {
+		return
+	}
+	//lastTime这一毫秒内每行在本次输出里出现的次数
+	seen := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		entry, ok := ParseLogcatLine(line)
+		if !ok {
+			continue
+		}
+		if entry.Time != logcat.lastTime {
+			logcat.lastTime = entry.Time
+			logcat.lastLines = make(map[string]int)
+			seen = make(map[string]int)
+		}
+		// -T 包含起始时间本身,按次数跳过上一次已经发送的行,同一毫秒内相同的多行不会被去掉
+		seen[line]++
+		if seen[line] <= logcat.lastLines[line] {
+			continue
+		}
+		logcat.lastLines[line] = seen[line]
+		if logcat.capture {
+			logcat.writeCapture(line)
+		}
+		for sub := range logcat.subscribers {
+			if !sub.filter.Match(entry) {
+				continue
+			}
+			select {
+			case sub.ch <- entry:
+			default:
+				//订阅者太慢直接丢弃
+			}
+		}
+	}
+}
+
+// 按包名过滤时刷新pid,2秒刷新一次
+func (logcat *Logcat) refreshPids() {
+	logcat.mu.Lock()
+	if time.Since(logcat.pidTime) < time.Second*2 {
+		logcat.mu.Unlock()
+		return
+	}
+	logcat.pidTime = time.Now()
+	var filters []*LogFilter
+	for sub := range logcat.subscribers {
+		if len(sub.filter.Package) > 0 {
+			filters = append(filters, sub.filter)
+		}
+	}
+	logcat.mu.Unlock()
+	for _, filter := range filters {
+		out, err := logcat.wsServer.Shell("pidof " + filter.Package)
+		if err != nil {
+			continue
+		}
+		pids := make(map[int]bool)
+		for _, field := range strings.Fields(out) {
+			if pid, err := strconv.Atoi(field); err == nil {
+				pids[pid] = true
+			}
+		}
+		logcat.mu.Lock()
+		filter.pids = pids
+		logcat.mu.Unlock()
+	}
+}
+
+// 写入落盘文件,超过大小后轮转 logcat.txt -> logcat.1.txt -> ...
+func (logcat *Logcat) writeCapture(line string) {
+	maxSize := logcat.config.LogcatMaxSize
+	if maxSize <= 0 {
+		maxSize = 10 * 1024 * 1024
+	}
+	if logcat.file != nil && logcat.fileSize >= maxSize {
+		logcat.file.Close()
+		logcat.file = nil
+		logcat.rotate()
+	}
+	if logcat.file == nil {
+		os.MkdirAll(logcat.config.LogcatDir, 0755)
+		f, err := os.OpenFile(filepath.Join(logcat.config.LogcatDir, "logcat.txt"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Printf("logcat capture err:%+v\r\n", err)
+			return
+		}
+		info, _ := f.Stat()
+		logcat.file = f
+		logcat.fileSize = info.Size()
+	}
+	n, _ := logcat.file.WriteString(strings.TrimRight(line, "\r") + "\n")
+	logcat.fileSize += int64(n)
+}
+
+func (logcat *Logcat) rotate() {
+	maxFiles := logcat.config.LogcatMaxFiles
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+	dir := logcat.config.LogcatDir
+	os.Remove(filepath.Join(dir, fmt.Sprintf("logcat.%d.txt", maxFiles-1)))
+	for i := maxFiles - 2; i >= 1; i-- {
+		os.Rename(filepath.Join(dir, fmt.Sprintf("logcat.%d.txt", i)), filepath.Join(dir, fmt.Sprintf("logcat.%d.txt", i+1)))
+	}
+	os.Rename(filepath.Join(dir, "logcat.txt"), filepath.Join(dir, "logcat.1.txt"))
+}
+
+/*
+GET /api/devices/{id}/logcat?level=W&tag=a,b&package=com.x&regex=...
+带Upgrade头时走websocket,否则走SSE
+*/
+func (wsServer *WsServer) handleLogcat(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	filter, err := NewLogFilter(query.Get("level"), query.Get("tag"), query.Get("package"), query.Get("regex"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sub := wsServer.logcat.Subscribe(filter)
+		defer wsServer.logcat.Unsubscribe(sub)
+		//读协程用于感知断开
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					wsServer.logcat.Unsubscribe(sub)
+					return
+				}
+			}
+		}()
+		for entry := range sub.ch {
+			if err := conn.WriteJSON(entry); err != nil {
+				return
+			}
+		}
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	sub := wsServer.logcat.Subscribe(filter)
+	defer wsServer.logcat.Unsubscribe(sub)
+	for {
+		select {
+		case entry, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(entry)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package comm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// matroska/webm录制,支持h264/h265/av1和opus,结束时写入Cues和SeekHead方便拖动
+
+const (
+	mkvEBML           = 0x1A45DFA3
+	mkvEBMLVersion    = 0x4286
+	mkvEBMLReadVer    = 0x42F7
+	mkvEBMLMaxIDLen   = 0x42F2
+	mkvEBMLMaxSizeLen = 0x42F3
+	mkvDocType        = 0x4282
+	mkvDocTypeVer     = 0x4287
+	mkvDocTypeReadVer = 0x4285
+	mkvSegment        = 0x18538067
+	mkvSeekHead       = 0x114D9B74
+	mkvSeek           = 0x4DBB
+	mkvSeekID         = 0x53AB
+	mkvSeekPosition   = 0x53AC
+	mkvVoid           = 0xEC
+	mkvInfo           = 0x1549A966
+	mkvTimecodeScale  = 0x2AD7B1
+	mkvDuration       = 0x4489
+	mkvMuxingApp      = 0x4D80
+	mkvWritingApp     = 0x5741
+	mkvTracks         = 0x1654AE6B
+	mkvTrackEntry     = 0xAE
+	mkvTrackNumber    = 0xD7
+	mkvTrackUID       = 0x73C5
+	mkvTrackType      = 0x83
+	mkvCodecID        = 0x86
+	mkvCodecPrivate   = 0x63A2
+	mkvCodecDelay     = 0x56AA
+	mkvSeekPreRoll    = 0x56BB
+	mkvVideo          = 0xE0
+	mkvPixelWidth     = 0xB0
+	mkvPixelHeight    = 0xBA
+	mkvAudio          = 0xE1
+	mkvSamplingFreq   = 0xB5
+	mkvChannels       = 0x9F
+	mkvCluster        = 0x1F43B675
+	mkvTimecode       = 0xE7
+	mkvSimpleBlock    = 0xA3
+	mkvCues           = 0x1C53BB6B
+	mkvCuePoint       = 0xBB
+	mkvCueTime        = 0xB3
+	mkvCueTrackPos    = 0xB7
+	mkvCueTrack       = 0xF7
+	mkvCueClusterPos  = 0xF1
+
+	mkvVideoTrack = 1
+	mkvAudioTrack = 2
+)
+
+func ebmlId(id uint32) []byte {
+	switch {
+	case id >= 0x1000000:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 0x10000:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 0x100:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// 元素长度统一用8字节编码,方便事后回填
+func ebmlSize8(size uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, size|0x0100000000000000)
+}
+
+func ebmlElement(id uint32, payloads ...[]byte) []byte {
+	size := 0
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	buf := ebmlId(id)
+	buf = append(buf, ebmlSize8(uint64(size))...)
+	for _, payload := range payloads {
+		buf = append(buf, payload...)
+	}
+	return buf
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, value))
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+type mkvCuePointInfo struct {
+	time     uint64
+	position uint64
+}
+
+type mkvFileMuxer struct {
+	file          *os.File
+	mimeType      string
+	segmentStart  int64 //segment数据区起始位置,SeekPosition/CueClusterPosition都相对它
+	seekHeadPos   int64
+	durationPos   int64
+	infoPos       int64
+	tracksPos     int64
+	baseTime      int64 //微秒
+	lastTime      int64
+	cluster       bytes.Buffer
+	clusterTime   int64 //毫秒
+	clusterHasKey bool
+	cues          []mkvCuePointInfo
+}
+
+func newMkvFileMuxer(path string, first *Sample, width int, height int, opusHead *OpusHead) (*mkvFileMuxer, error) {
+	var codecId string
+	var codecPrivate []byte
+	docType := "matroska"
+	if !strings.EqualFold(first.MimeType, webrtc.MimeTypeAV1) {
+		if err := checkParams(first.MimeType, first.Params); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case strings.EqualFold(first.MimeType, webrtc.MimeTypeH264):
+		codecId, codecPrivate = "V_MPEG4/ISO/AVC", avcDecoderConfig(first.Params)
+	case strings.EqualFold(first.MimeType, webrtc.MimeTypeH265):
+		codecId, codecPrivate = "V_MPEGH/ISO/HEVC", hevcDecoderConfig(first.Params)
+	case strings.EqualFold(first.MimeType, webrtc.MimeTypeAV1):
+		codecId, codecPrivate = "V_AV1", av1DecoderConfig(first.Params)
+		docType = "webm"
+	default:
+		return nil, errors.New("mkv unsupported codec " + first.MimeType)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	mkv := &mkvFileMuxer{file: file, mimeType: first.MimeType, baseTime: first.Timestamp}
+	header := ebmlElement(mkvEBML,
+		ebmlUint(mkvEBMLVersion, 1), ebmlUint(mkvEBMLReadVer, 1),
+		ebmlUint(mkvEBMLMaxIDLen, 4), ebmlUint(mkvEBMLMaxSizeLen, 8),
+		ebmlString(mkvDocType, docType), ebmlUint(mkvDocTypeVer, 4), ebmlUint(mkvDocTypeReadVer, 2))
+	//segment长度未知,关闭时回填
+	header = append(header, ebmlId(mkvSegment)...)
+	header = append(header, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	mkv.segmentStart = int64(len(header))
+
+	//预留SeekHead空间
+	mkv.seekHeadPos = 0
+	reserved := ebmlElement(mkvVoid, make([]byte, 160))
+
+	mkv.infoPos = int64(len(reserved))
+	info := ebmlElement(mkvInfo,
+		ebmlUint(mkvTimecodeScale, 1000000),
+		ebmlFloat(mkvDuration, 0),
+		ebmlString(mkvMuxingApp, "castX"), ebmlString(mkvWritingApp, "castX"))
+	//Duration的值在info里的偏移:info头(4+8)+TimecodeScale(3+8+8)+Duration头(2+8)
+	mkv.durationPos = mkv.segmentStart + mkv.infoPos + 12 + 19 + 10
+
+	channels, preSkip, sampleRate, _ := opusParams(opusHead)
+	opusPrivate := []byte("OpusHead")
+	opusPrivate = append(opusPrivate, 1, channels)
+	opusPrivate = binary.LittleEndian.AppendUint16(opusPrivate, preSkip)
+	opusPrivate = binary.LittleEndian.AppendUint32(opusPrivate, sampleRate)
+	opusPrivate = append(opusPrivate, 0, 0, 0)
+	mkv.tracksPos = mkv.infoPos + int64(len(info))
+	tracks := ebmlElement(mkvTracks,
+		ebmlElement(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, mkvVideoTrack), ebmlUint(mkvTrackUID, mkvVideoTrack), ebmlUint(mkvTrackType, 1),
+			ebmlString(mkvCodecID, codecId), ebmlElement(mkvCodecPrivate, codecPrivate),
+			ebmlElement(mkvVideo, ebmlUint(mkvPixelWidth, uint64(width)), ebmlUint(mkvPixelHeight, uint64(height)))),
+		ebmlElement(mkvTrackEntry,
+			ebmlUint(mkvTrackNumber, mkvAudioTrack), ebmlUint(mkvTrackUID, mkvAudioTrack), ebmlUint(mkvTrackType, 2),
+			ebmlString(mkvCodecID, "A_OPUS"), ebmlElement(mkvCodecPrivate, opusPrivate),
+			ebmlUint(mkvCodecDelay, uint64(preSkip)*1000000000/48000), ebmlUint(mkvSeekPreRoll, 80000000),
+			ebmlElement(mkvAudio, ebmlFloat(mkvSamplingFreq, float64(sampleRate)), ebmlUint(mkvChannels, uint64(channels)))))
+
+	header = append(header, reserved...)
+	header = append(header, info...)
+	header = append(header, tracks...)
+	if _, err = file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return mkv, nil
+}
+
+func (mkv *mkvFileMuxer) WriteSample(sample *Sample) error {
+	if sample.Timestamp < mkv.baseTime {
+		return nil
+	}
+	timecode := (sample.Timestamp - mkv.baseTime) / 1000
+	//SimpleBlock的相对时间是int16,关键帧或者超过30秒时开新的cluster
+	if mkv.cluster.Len() == 0 || timecode-mkv.clusterTime > 30000 || (!sample.Audio && sample.KeyFrame) {
+		if err := mkv.flushCluster(); err != nil {
+			return err
+		}
+		mkv.clusterTime = timecode
+		mkv.clusterHasKey = !sample.Audio && sample.KeyFrame
+		mkv.cluster.Write(ebmlUint(mkvTimecode, uint64(timecode)))
+	}
+	relative := timecode - mkv.clusterTime
+	if relative < math.MinInt16 || relative > math.MaxInt16 {
+		return nil
+	}
+	track := byte(0x80 | mkvVideoTrack)
+	data := sample.LengthPrefixed()
+	flags := byte(0)
+	if sample.Audio {
+		track = 0x80 | mkvAudioTrack
+		flags = 0x80
+	} else if sample.KeyFrame {
+		flags = 0x80
+	}
+	block := []byte{track, byte(uint16(relative) >> 8), byte(relative), flags}
+	mkv.cluster.Write(ebmlElement(mkvSimpleBlock, block, data))
+	if end := sample.Timestamp + int64(sample.Duration/time.Microsecond); end > mkv.lastTime {
+		mkv.lastTime = end
+	}
+	return nil
+}
+
+func (mkv *mkvFileMuxer) flushCluster() error {
+	if mkv.cluster.Len() == 0 {
+		return nil
+	}
+	pos, err := mkv.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if mkv.clusterHasKey {
+		mkv.cues = append(mkv.cues, mkvCuePointInfo{time: uint64(mkv.clusterTime), position: uint64(pos - mkv.segmentStart)})
+	}
+	_, err = mkv.file.Write(ebmlElement(mkvCluster, mkv.cluster.Bytes()))
+	mkv.cluster.Reset()
+	return err
+}
+
+// 写入Cues,回填SeekHead,Duration和Segment长度
+func (mkv *mkvFileMuxer) Close() error {
+	defer mkv.file.Close()
+	if err := mkv.flushCluster(); err != nil {
+		return err
+	}
+	cuesPos, err := mkv.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var cuePoints [][]byte
+	for _, cue := range mkv.cues {
+		cuePoints = append(cuePoints, ebmlElement(mkvCuePoint,
+			ebmlUint(mkvCueTime, cue.time),
+			ebmlElement(mkvCueTrackPos, ebmlUint(mkvCueTrack, mkvVideoTrack), ebmlUint(mkvCueClusterPos, cue.position))))
+	}
+	if len(cuePoints) > 0 {
+		if _, err = mkv.file.Write(ebmlElement(mkvCues, cuePoints...)); err != nil {
+			return err
+		}
+	}
+	end, err := mkv.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	seeks := [][]byte{
+		ebmlElement(mkvSeek, ebmlElement(mkvSeekID, ebmlId(mkvInfo)), ebmlUint(mkvSeekPosition, uint64(mkv.infoPos))),
+		ebmlElement(mkvSeek, ebmlElement(mkvSeekID, ebmlId(mkvTracks)), ebmlUint(mkvSeekPosition, uint64(mkv.tracksPos))),
+	}
+	if len(cuePoints) > 0 {
+		seeks = append(seeks, ebmlElement(mkvSeek, ebmlElement(mkvSeekID, ebmlId(mkvCues)), ebmlUint(mkvSeekPosition, uint64(cuesPos-mkv.segmentStart))))
+	}
+	seekHead := ebmlElement(mkvSeekHead, seeks...)
+	//剩余空间用Void填满,Void头固定9字节
+	seekHead = append(seekHead, ebmlElement(mkvVoid, make([]byte, int(mkv.infoPos)-len(seekHead)-9))...)
+	if _, err = mkv.file.WriteAt(seekHead, mkv.segmentStart+mkv.seekHeadPos); err != nil {
+		return err
+	}
+	duration := float64(max(mkv.lastTime-mkv.baseTime, 0)) / 1000
+	if _, err = mkv.file.WriteAt(binary.BigEndian.AppendUint64(nil, math.Float64bits(duration)), mkv.durationPos); err != nil {
+		return err
+	}
+	_, err = mkv.file.WriteAt(ebmlSize8(uint64(end-mkv.segmentStart)), mkv.segmentStart-8)
+	return err
+}
+
+/*
+AV1CodecConfigurationRecord
+只解析sequence header开头的profile/level,位深和采样格式按8bit 4:2:0填写
+*/
+func av1DecoderConfig(params [][]byte) []byte {
+	config := []byte{0x81, 0x00, 0x0C, 0x00}
+	if len(params) == 0 {
+		return config
+	}
+	seqHeader := params[0]
+	headerSize := 1
+	if seqHeader[0]&0x04 != 0 {
+		headerSize++
+	}
+	_, n := readLeb128(seqHeader[headerSize:])
+	reader := &BitReader{Reader: bytes.NewReader(seqHeader[headerSize+n:])}
+	seqProfile, _ := reader.ReadUint8(3)
+	reader.SkipBits(1) //still_picture
+	reduced, _ := reader.ReadUint8(1)
+	seqLevel := uint8(0)
+	seqTier := uint8(0)
+	if reduced == 1 {
+		seqLevel, _ = reader.ReadUint8(5)
+	} else {
+		timingInfo, _ := reader.ReadUint8(1)
+		if timingInfo == 0 {
+			reader.SkipBits(1)  //initial_display_delay_present_flag
+			reader.SkipBits(5)  //operating_points_cnt_minus_1
+			reader.SkipBits(12) //operating_point_idc[0]
+			seqLevel, _ = reader.ReadUint8(5)
+			if seqLevel > 7 {
+				seqTier, _ = reader.ReadUint8(1)
+			}
+		}
+	}
+	config[1] = seqProfile<<5 | seqLevel
+	config[2] |= seqTier << 7
+	return append(config, seqHeader...)
+}
@@ -0,0 +1,361 @@
+package comm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// fragmented mp4封装 ftyp+moov初始化段,之后是moof+mdat分片
+
+const (
+	mp4VideoTrackId   = 1
+	mp4AudioTrackId   = 2
+	mp4VideoTimescale = 90000
+	mp4AudioTimescale = 48000
+)
+
+var mp4Matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+	buf = append(buf, boxType...)
+	for _, payload := range payloads {
+		buf = append(buf, payload...)
+	}
+	return buf
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+type fmp4Muxer struct {
+	videoMime string
+	params    [][]byte
+	width     int
+	height    int
+	hasAudio  bool
+	opusHead  *OpusHead
+	sequence  uint32
+	baseTime  int64 //第一帧的时间戳(微秒),所有轨道以它为0点
+}
+
+func newFmp4Muxer(first *Sample, width int, height int, hasAudio bool, opusHead *OpusHead) (*fmp4Muxer, error) {
+	if !strings.EqualFold(first.MimeType, webrtc.MimeTypeH264) && !strings.EqualFold(first.MimeType, webrtc.MimeTypeH265) {
+		return nil, errors.New("mp4 unsupported codec " + first.MimeType)
+	}
+	if err := checkParams(first.MimeType, first.Params); err != nil {
+		return nil, err
+	}
+	return &fmp4Muxer{
+		videoMime: first.MimeType,
+		params:    first.Params,
+		width:     width,
+		height:    height,
+		hasAudio:  hasAudio,
+		opusHead:  opusHead,
+		baseTime:  first.Timestamp,
+	}, nil
+}
+
+func (muxer *fmp4Muxer) videoTime(timestamp int64) uint64 {
+	return uint64((timestamp - muxer.baseTime) * mp4VideoTimescale / 1000000)
+}
+
+func (muxer *fmp4Muxer) audioTime(timestamp int64) uint64 {
+	return uint64((timestamp - muxer.baseTime) * mp4AudioTimescale / 1000000)
+}
+
+func (muxer *fmp4Muxer) hevc() bool {
+	return strings.EqualFold(muxer.videoMime, webrtc.MimeTypeH265)
+}
+
+func (muxer *fmp4Muxer) initSegment() []byte {
+	ftyp := mp4Box("ftyp", []byte("iso5"), be32(512), []byte("iso5iso6mp41"))
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		be32(0), be32(0), be32(1000), be32(0),
+		be32(0x00010000), be16(0x0100), make([]byte, 10),
+		mp4Matrix, make([]byte, 24), be32(mp4AudioTrackId+1))
+	traks := [][]byte{mvhd, muxer.videoTrak()}
+	trexs := [][]byte{muxer.trex(mp4VideoTrackId)}
+	if muxer.hasAudio {
+		traks = append(traks, muxer.audioTrak())
+		trexs = append(trexs, muxer.trex(mp4AudioTrackId))
+	}
+	traks = append(traks, mp4Box("mvex", trexs...))
+	return append(ftyp, mp4Box("moov", traks...)...)
+}
+
+func (muxer *fmp4Muxer) trex(trackId uint32) []byte {
+	return mp4FullBox("trex", 0, 0, be32(trackId), be32(1), be32(0), be32(0), be32(0))
+}
+
+func mp4Stbl(sampleEntry []byte) []byte {
+	return mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, be32(0)),
+		mp4FullBox("stsc", 0, 0, be32(0)),
+		mp4FullBox("stsz", 0, 0, be32(0), be32(0)),
+		mp4FullBox("stco", 0, 0, be32(0)))
+}
+
+func mp4Dinf() []byte {
+	return mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+}
+
+func (muxer *fmp4Muxer) videoTrak() []byte {
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		be32(0), be32(0), be32(mp4VideoTrackId), be32(0), be32(0),
+		make([]byte, 8), be16(0), be16(0), be16(0), be16(0),
+		mp4Matrix, be32(uint32(muxer.width)<<16), be32(uint32(muxer.height)<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(mp4VideoTimescale), be32(0), be16(0x55C4), be16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+	vmhd := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+
+	entryType, config := "avc1", mp4Box("avcC", avcDecoderConfig(muxer.params))
+	if muxer.hevc() {
+		entryType, config = "hvc1", mp4Box("hvcC", hevcDecoderConfig(muxer.params))
+	}
+	sampleEntry := mp4Box(entryType,
+		make([]byte, 6), be16(1),
+		be16(0), be16(0), make([]byte, 12),
+		be16(uint16(muxer.width)), be16(uint16(muxer.height)),
+		be32(0x00480000), be32(0x00480000), be32(0), be16(1),
+		make([]byte, 32), be16(0x0018), be16(0xFFFF),
+		config)
+	minf := mp4Box("minf", vmhd, mp4Dinf(), mp4Stbl(sampleEntry))
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf))
+}
+
+func (muxer *fmp4Muxer) audioTrak() []byte {
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		be32(0), be32(0), be32(mp4AudioTrackId), be32(0), be32(0),
+		make([]byte, 8), be16(0), be16(1), be16(0x0100), be16(0),
+		mp4Matrix, be32(0), be32(0))
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(mp4AudioTimescale), be32(0), be16(0x55C4), be16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+	smhd := mp4FullBox("smhd", 0, 0, be16(0), be16(0))
+	channels, preSkip, sampleRate, gain := opusParams(muxer.opusHead)
+	dOps := mp4Box("dOps", []byte{0, channels}, be16(preSkip), be32(sampleRate), be16(uint16(gain)), []byte{0})
+	sampleEntry := mp4Box("Opus",
+		make([]byte, 6), be16(1),
+		make([]byte, 8), be16(uint16(channels)), be16(16), be16(0), be16(0),
+		be32(mp4AudioTimescale<<16), dOps)
+	minf := mp4Box("minf", smhd, mp4Dinf(), mp4Stbl(sampleEntry))
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf))
+}
+
+// 没有收到OpusHead时按scrcpy默认的48k双声道处理
+func opusParams(head *OpusHead) (channels byte, preSkip uint16, sampleRate uint32, gain int16) {
+	if head == nil || head.Channels == 0 {
+		return 2, 312, 48000, 0
+	}
+	return head.Channels, head.PreSkip, head.SampleRate, head.OutputGain
+}
+
+/*
+生成一个moof+mdat分片
+videoEnd是下一帧视频的时间戳,用于计算最后一帧的时长
+*/
+func (muxer *fmp4Muxer) fragment(video []*Sample, videoEnd int64, audio []*Sample) []byte {
+	muxer.sequence++
+	var videoData, audioData [][]byte
+	videoSize, audioSize := 0, 0
+	for _, sample := range video {
+		data := sample.LengthPrefixed()
+		videoData = append(videoData, data)
+		videoSize += len(data)
+	}
+	for _, sample := range audio {
+		audioData = append(audioData, sample.Data)
+		audioSize += len(sample.Data)
+	}
+	build := func(moofSize int) []byte {
+		mfhd := mp4FullBox("mfhd", 0, 0, be32(muxer.sequence))
+		trafs := [][]byte{mfhd}
+		if len(video) > 0 {
+			trafs = append(trafs, muxer.videoTraf(video, videoData, videoEnd, moofSize+8))
+		}
+		if len(audio) > 0 {
+			trafs = append(trafs, muxer.audioTraf(audio, audioData, moofSize+8+videoSize))
+		}
+		return mp4Box("moof", trafs...)
+	}
+	moof := build(0)
+	moof = build(len(moof))
+	mdat := mp4Box("mdat", append(videoData, audioData...)...)
+	return append(moof, mdat...)
+}
+
+func (muxer *fmp4Muxer) videoTraf(video []*Sample, data [][]byte, videoEnd int64, dataOffset int) []byte {
+	tfhd := mp4FullBox("tfhd", 0, 0x020000, be32(mp4VideoTrackId))
+	tfdt := mp4FullBox("tfdt", 1, 0, be64(muxer.videoTime(video[0].Timestamp)))
+	entries := [][]byte{be32(uint32(len(video))), be32(uint32(dataOffset))}
+	for i, sample := range video {
+		next := videoEnd
+		if i+1 < len(video) {
+			next = video[i+1].Timestamp
+		}
+		if next <= sample.Timestamp {
+			next = sample.Timestamp + int64(sample.Duration/1000)
+		}
+		duration := muxer.videoTime(next) - muxer.videoTime(sample.Timestamp)
+		flags := uint32(0x01010000)
+		if sample.KeyFrame {
+			flags = 0x02000000
+		}
+		entries = append(entries, be32(uint32(duration)), be32(uint32(len(data[i]))), be32(flags))
+	}
+	trun := mp4FullBox("trun", 0, 0x000701, entries...)
+	return mp4Box("traf", tfhd, tfdt, trun)
+}
+
+func (muxer *fmp4Muxer) audioTraf(audio []*Sample, data [][]byte, dataOffset int) []byte {
+	tfhd := mp4FullBox("tfhd", 0, 0x020000, be32(mp4AudioTrackId))
+	tfdt := mp4FullBox("tfdt", 1, 0, be64(muxer.audioTime(audio[0].Timestamp)))
+	entries := [][]byte{be32(uint32(len(audio))), be32(uint32(dataOffset))}
+	for i, sample := range audio {
+		var duration uint64
+		if i+1 < len(audio) && audio[i+1].Timestamp > sample.Timestamp {
+			duration = muxer.audioTime(audio[i+1].Timestamp) - muxer.audioTime(sample.Timestamp)
+		} else {
+			duration = uint64(sample.Duration) * mp4AudioTimescale / 1000000000
+		}
+		if duration == 0 {
+			duration = mp4AudioTimescale / 50
+		}
+		entries = append(entries, be32(uint32(duration)), be32(uint32(len(data[i]))))
+	}
+	trun := mp4FullBox("trun", 0, 0x000301, entries...)
+	return mp4Box("traf", tfhd, tfdt, trun)
+}
+
+// MSE等使用的codecs参数,例如avc1.42e01f、hvc1.1.6.L93.B0
+func mp4CodecString(mimeType string, params [][]byte) string {
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH265) {
+		sps := params[0]
+		if len(sps) < 4 {
+			return "avc1.42e01f"
+		}
+		return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+	}
+	rbsp := unescapeRbsp(params[1])
+	if len(rbsp) < 15 {
+		return "hvc1.1.6.L93.B0"
+	}
+	ptl := rbsp[3:15]
+	codec := "hvc1." + []string{"", "A", "B", "C"}[ptl[0]>>6] + strconv.Itoa(int(ptl[0]&0x1F))
+	//兼容标志按位反序
+	compat := bits.Reverse32(binary.BigEndian.Uint32(ptl[1:5]))
+	codec += "." + strconv.FormatUint(uint64(compat), 16)
+	tier := "L"
+	if ptl[0]&0x20 != 0 {
+		tier = "H"
+	}
+	codec += "." + tier + strconv.Itoa(int(ptl[11]))
+	constraint := ptl[5:11]
+	for len(constraint) > 0 && constraint[len(constraint)-1] == 0 {
+		constraint = constraint[:len(constraint)-1]
+	}
+	for _, b := range constraint {
+		codec += fmt.Sprintf(".%X", b)
+	}
+	return codec
+}
+
+/*
+检查h264/h265的参数集是否齐全,WHIP和中继的输入不可信,缺少或者太短时不能生成解码配置
+h264为sps/pps,h265为vps/sps/pps,sps至少要带上profile和level
+*/
+func checkParams(mimeType string, params [][]byte) error {
+	count, spsIndex := 2, 0
+	if strings.EqualFold(mimeType, webrtc.MimeTypeH265) {
+		count, spsIndex = 3, 1
+	}
+	if len(params) < count {
+		return errors.New("missing parameter sets")
+	}
+	for _, param := range params[:count] {
+		if len(param) == 0 {
+			return errors.New("empty parameter set")
+		}
+	}
+	if len(params[spsIndex]) < 4 {
+		return errors.New("sps too short")
+	}
+	return nil
+}
+
+// AVCDecoderConfigurationRecord,调用前用checkParams检查
+func avcDecoderConfig(params [][]byte) []byte {
+	sps, pps := params[0], params[1]
+	buf := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	buf = append(buf, be16(uint16(len(sps)))...)
+	buf = append(buf, sps...)
+	buf = append(buf, 1)
+	buf = append(buf, be16(uint16(len(pps)))...)
+	return append(buf, pps...)
+}
+
+// 去掉防竞争字节 00 00 03
+func unescapeRbsp(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// HEVCDecoderConfigurationRecord,profile_tier_level直接从sps里拷贝,调用前用checkParams检查
+func hevcDecoderConfig(params [][]byte) []byte {
+	vps, sps, pps := params[0], params[1], params[2]
+	ptl := make([]byte, 12)
+	rbsp := unescapeRbsp(sps)
+	temporalIdNested := byte(0)
+	if len(rbsp) >= 15 {
+		copy(ptl, rbsp[3:15])
+		temporalIdNested = rbsp[2] & 0x01
+	}
+	buf := []byte{1}
+	buf = append(buf, ptl...)
+	buf = append(buf, 0xF0, 0x00, 0xFC, 0xFD, 0xF8, 0xF8, 0x00, 0x00)
+	buf = append(buf, (1<<3)|(temporalIdNested<<2)|0x03)
+	buf = append(buf, 3)
+	for i, nalu := range [][]byte{vps, sps, pps} {
+		buf = append(buf, 0x80|byte(32+i))
+		buf = append(buf, be16(1)...)
+		buf = append(buf, be16(uint16(len(nalu)))...)
+		buf = append(buf, nalu...)
+	}
+	return buf
+}
@@ -0,0 +1,152 @@
+package comm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	peerConnectTimeout    = 30 * time.Second //创建后一直没连上就关闭
+	peerDisconnectTimeout = 15 * time.Second //断开后没有恢复就关闭
+)
+
+/*
+观看端连接,按会话保存(websocket连接或者WHEP会话),
+同一个会话重新协商时关闭旧连接,会话结束、ice失败或者超时都会关闭并更新连接数
+*/
+type viewerPeer struct {
+	session        string
+	peerConnection *webrtc.PeerConnection
+	connected      bool
+	closed         bool
+	timer          *time.Timer
+	videoTrack     *webrtc.TrackLocalStaticRTP
+	audioTrack     *webrtc.TrackLocalStaticRTP
+	writer         *peerWriter //连上后才创建,peerMu保护
+	estimator      cc.BandwidthEstimator
+}
+
+func (webrtcServer *WebrtcServer) addPeer(peer *viewerPeer) {
+	webrtcServer.peerMu.Lock()
+	old := webrtcServer.peers[peer.session]
+	webrtcServer.peers[peer.session] = peer
+	peer.timer = time.AfterFunc(peerConnectTimeout, func() {
+		fmt.Printf("peer %s connect timeout\r\n", peer.session)
+		webrtcServer.closePeer(peer)
+	})
+	webrtcServer.peerMu.Unlock()
+	if old != nil {
+		webrtcServer.closePeer(old)
+	}
+}
+
+func (webrtcServer *WebrtcServer) peerStateChange(peer *viewerPeer, state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		webrtcServer.peerMu.Lock()
+		if peer.timer != nil {
+			peer.timer.Stop()
+		}
+		changed := !peer.connected && !peer.closed
+		if changed {
+			peer.connected = true
+			webrtcServer.peerConnectionCount++
+		}
+		count := webrtcServer.peerConnectionCount
+		webrtcServer.peerMu.Unlock()
+		if changed {
+			go webrtcServer.startPeerVideo(peer)
+			webrtcServer.startAbr()
+			webrtcServer.notifyPeerCount(count)
+		}
+	case webrtc.PeerConnectionStateDisconnected:
+		//可能只是网络抖动,超时后还没恢复再关闭
+		webrtcServer.peerMu.Lock()
+		if peer.timer != nil && !peer.closed {
+			peer.timer.Reset(peerDisconnectTimeout)
+		}
+		webrtcServer.peerMu.Unlock()
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		webrtcServer.closePeer(peer)
+	}
+}
+
+// 关闭连接并从登记表移除,重复调用只计数一次
+func (webrtcServer *WebrtcServer) closePeer(peer *viewerPeer) {
+	webrtcServer.peerMu.Lock()
+	if peer.closed {
+		webrtcServer.peerMu.Unlock()
+		return
+	}
+	peer.closed = true
+	if peer.timer != nil {
+		peer.timer.Stop()
+	}
+	if webrtcServer.peers[peer.session] == peer {
+		delete(webrtcServer.peers, peer.session)
+	}
+	changed := peer.connected
+	if changed {
+		peer.connected = false
+		webrtcServer.peerConnectionCount--
+	}
+	if peer.writer != nil {
+		peer.writer.close()
+		peer.writer = nil
+	}
+	count := webrtcServer.peerConnectionCount
+	webrtcServer.peerMu.Unlock()
+	go peer.peerConnection.Close()
+	if changed {
+		webrtcServer.notifyPeerCount(count)
+	}
+}
+
+func (webrtcServer *WebrtcServer) notifyPeerCount(count int64) {
+	if webrtcServer.webRtcConnectionStateChange != nil {
+		webrtcServer.webRtcConnectionStateChange(int(count))
+	}
+}
+
+// 会话当前的连接,没有时返回nil
+func (webrtcServer *WebrtcServer) Peer(session string) *webrtc.PeerConnection {
+	webrtcServer.peerMu.Lock()
+	defer webrtcServer.peerMu.Unlock()
+	if peer, ok := webrtcServer.peers[session]; ok {
+		return peer.peerConnection
+	}
+	return nil
+}
+
+// 关闭会话的连接,会话不存在时返回false
+func (webrtcServer *WebrtcServer) ClosePeer(session string) bool {
+	webrtcServer.peerMu.Lock()
+	peer, ok := webrtcServer.peers[session]
+	webrtcServer.peerMu.Unlock()
+	if ok {
+		webrtcServer.closePeer(peer)
+	}
+	return ok
+}
+
+func (webrtcServer *WebrtcServer) ClosePeers() {
+	webrtcServer.peerMu.Lock()
+	peers := make([]*viewerPeer, 0, len(webrtcServer.peers))
+	for _, peer := range webrtcServer.peers {
+		peers = append(peers, peer)
+	}
+	webrtcServer.peerMu.Unlock()
+	for _, peer := range peers {
+		webrtcServer.closePeer(peer)
+	}
+}
+
+// 已连接的观看端数量
+func (webrtcServer *WebrtcServer) PeerCount() int {
+	webrtcServer.peerMu.Lock()
+	defer webrtcServer.peerMu.Unlock()
+	return int(webrtcServer.peerConnectionCount)
+}
@@ -0,0 +1,150 @@
+package comm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	rawFrameHeaderSize = 12
+	rawQueueSize       = 64 //每个订阅者最多积压的包数
+)
+
+/*
+裸码流输出,每个websocket二进制消息是一个包,包头和scrcpy的帧头一致:
+8字节大端 [config:1][keyFrame:1][pts微秒:62] + 4字节大端数据长度,后面是annex-b数据
+config包是参数集(h264:sps,pps h265:vps,sps,pps av1:sequence header),
+每次(重新)初始化先发一条文本消息{"type":"init","mimeType":"video/H264","codec":"avc1.42e01f","width":0,"height":0}
+*/
+type RawFrame struct {
+	Config   bool
+	KeyFrame bool
+	PTS      int64 //微秒
+	Data     []byte
+}
+
+func (frame *RawFrame) Marshal() []byte {
+	header := uint64(frame.PTS) & 0x3FFFFFFFFFFFFFFF
+	if frame.Config {
+		header |= 1 << 63
+	}
+	if frame.KeyFrame {
+		header |= 1 << 62
+	}
+	buf := make([]byte, 0, rawFrameHeaderSize+len(frame.Data))
+	buf = binary.BigEndian.AppendUint64(buf, header)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(frame.Data)))
+	return append(buf, frame.Data...)
+}
+
+// 解析一个二进制消息,给不使用webrtc的go客户端用
+func ParseRawFrame(data []byte) (*RawFrame, error) {
+	if len(data) < rawFrameHeaderSize {
+		return nil, errors.New("raw frame too short")
+	}
+	header := binary.BigEndian.Uint64(data[0:8])
+	size := binary.BigEndian.Uint32(data[8:12])
+	if int(size) != len(data)-rawFrameHeaderSize {
+		return nil, errors.New("raw frame length mismatch")
+	}
+	return &RawFrame{
+		Config:   (header>>63)&0x01 == 1,
+		KeyFrame: (header>>62)&0x01 == 1,
+		PTS:      int64(header & 0x3FFFFFFFFFFFFFFF),
+		Data:     data[rawFrameHeaderSize:],
+	}, nil
+}
+
+type rawSink struct {
+	conn    *websocket.Conn
+	config  *Config
+	params  [][]byte
+	started bool
+	closed  bool //写失败或超时后关闭连接,读循环退出后RemoveSink
+}
+
+func (sink *rawSink) WriteSample(sample *Sample) {
+	if sink.closed || sample.Audio {
+		return
+	}
+	if sample.KeyFrame && (!sink.started || !sameParams(sink.params, sample.Params)) {
+		sink.start(sample)
+	}
+	if !sink.started {
+		return
+	}
+	frame := &RawFrame{KeyFrame: sample.KeyFrame, PTS: sample.Timestamp, Data: sample.AnnexB(false)}
+	sink.write(websocket.BinaryMessage, frame.Marshal())
+}
+
+// 设备断开,下一个关键帧重新初始化
+func (sink *rawSink) StreamEnd() {
+	sink.started = false
+}
+
+func (sink *rawSink) start(first *Sample) {
+	width, height := videoSize(sink.config, first)
+	init := map[string]interface{}{"type": "init", "mimeType": first.MimeType, "width": width, "height": height}
+	if len(first.Nalus) > 0 && checkParams(first.MimeType, first.Params) == nil {
+		init["codec"] = mp4CodecString(first.MimeType, first.Params)
+	}
+	data, _ := json.Marshal(init)
+	sink.write(websocket.TextMessage, data)
+	var configData []byte
+	if len(first.Nalus) > 0 {
+		configData = (&Sample{Nalus: first.Params}).AnnexB(false)
+	} else if len(first.Params) > 0 {
+		//av1的sequence header
+		configData = first.Params[0]
+	}
+	config := &RawFrame{Config: true, PTS: first.Timestamp, Data: configData}
+	sink.write(websocket.BinaryMessage, config.Marshal())
+	sink.params = first.Params
+	sink.started = !sink.closed
+}
+
+func (sink *rawSink) write(messageType int, data []byte) {
+	if sink.closed {
+		return
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := sink.conn.WriteMessage(messageType, data); err != nil {
+		sink.closed = true
+		sink.conn.Close()
+	}
+}
+
+/*
+GET /raw 或 /api/devices/{id}/raw (websocket)
+鉴权和WHEP一致,适合WebCodecs直接解码,每个订阅者有自己的队列,慢的订阅者丢帧到下一个关键帧
+*/
+func (wsServer *WsServer) handleRaw(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkBearerAuth(w, r) {
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	sink := &rawSink{conn: conn, config: wsServer.config}
+	wsServer.webrtcServer.addSink(sink, rawQueueSize)
+	//从关键帧开始
+	wsServer.webrtcServer.RequestKeyFrame()
+	//读协程用于感知断开
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	conn.Close()
+	wsServer.webrtcServer.RemoveSink(sink)
+}
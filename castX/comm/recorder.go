@@ -0,0 +1,379 @@
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// 录制文件封装格式
+type recordMuxer interface {
+	WriteSample(sample *Sample) error
+	Close() error
+}
+
+// 录制文件信息
+type RecordingInfo struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+/*
+录制,作为SampleSink挂在WebrtcServer上
+从关键帧开始写文件,分辨率(参数集)变化时切换到新文件
+*/
+type Recorder struct {
+	config       *Config
+	webrtcServer *WebrtcServer
+	mu           sync.Mutex
+	recording    bool
+	format       string
+	muxer        recordMuxer
+	params       [][]byte
+	fileName     string
+	lastErr      string //写文件失败的原因,失败后停止录制
+}
+
+func NewRecorder(config *Config, webrtcServer *WebrtcServer) *Recorder {
+	return &Recorder{config: config, webrtcServer: webrtcServer}
+}
+
+func (recorder *Recorder) dir() string {
+	if len(recorder.config.RecordDir) > 0 {
+		return recorder.config.RecordDir
+	}
+	return "recordings"
+}
+
+func (recorder *Recorder) Start(format string) error {
+	if len(format) == 0 {
+		format = "mp4"
+	}
+	if err := recorder.checkFormat(format); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(recorder.dir(), 0755); err != nil {
+		return err
+	}
+	recorder.mu.Lock()
+	if recorder.recording {
+		recorder.mu.Unlock()
+		return errors.New("already recording")
+	}
+	recorder.recording = true
+	recorder.format = format
+	recorder.lastErr = ""
+	recorder.mu.Unlock()
+	//失败停止后接收端还挂着,这里不会重复添加
+	recorder.webrtcServer.AddSink(recorder)
+	return nil
+}
+
+// 检查当前编码是否支持该封装格式
+func (recorder *Recorder) checkFormat(format string) error {
+	mimeType := recorder.webrtcServer.MimeType()
+	switch format {
+	case "mp4":
+		if strings.EqualFold(mimeType, webrtc.MimeTypeAV1) {
+			return errors.New("mp4 record unsupported codec " + mimeType)
+		}
+	case "mkv":
+	case "webm":
+		if !strings.EqualFold(mimeType, webrtc.MimeTypeAV1) {
+			return errors.New("webm record unsupported codec " + mimeType)
+		}
+	default:
+		return errors.New("unsupported record format " + format)
+	}
+	return nil
+}
+
+func (recorder *Recorder) Stop() error {
+	recorder.webrtcServer.RemoveSink(recorder)
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if !recorder.recording {
+		return errors.New("not recording")
+	}
+	recorder.recording = false
+	return recorder.closeMuxer()
+}
+
+func (recorder *Recorder) Recording() bool {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return recorder.recording
+}
+
+// 当前正在写的文件名
+func (recorder *Recorder) FileName() string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return recorder.fileName
+}
+
+func (recorder *Recorder) closeMuxer() error {
+	if recorder.muxer == nil {
+		return nil
+	}
+	err := recorder.muxer.Close()
+	recorder.muxer = nil
+	recorder.params = nil
+	recorder.fileName = ""
+	return err
+}
+
+func (recorder *Recorder) WriteSample(sample *Sample) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if !recorder.recording {
+		return
+	}
+	if !sample.Audio && sample.KeyFrame && recorder.muxer != nil && !sameParams(recorder.params, sample.Params) {
+		//分辨率变化,重新开一个文件
+		recorder.closeMuxer()
+	}
+	if recorder.muxer == nil {
+		if sample.Audio || !sample.KeyFrame {
+			return
+		}
+		if err := recorder.openMuxer(sample); err != nil {
+			recorder.fail(err)
+			return
+		}
+	}
+	if err := recorder.muxer.WriteSample(sample); err != nil {
+		recorder.closeMuxer()
+		recorder.fail(err)
+	}
+}
+
+/*
+写文件失败,停止录制
+接收端不在这里移除(在队列协程里移除会死锁),之后的样本直接丢弃,Stop时再移除;
+失败后重新Start时接收端还在,直接继续用
+*/
+func (recorder *Recorder) fail(err error) {
+	fmt.Printf("Recorder err:%+v\r\n", err)
+	recorder.recording = false
+	recorder.lastErr = err.Error()
+}
+
+// 最近一次录制失败的原因
+func (recorder *Recorder) LastError() string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return recorder.lastErr
+}
+
+// 设备断开时结束当前文件,重新连接后从新的关键帧开始写新文件
+func (recorder *Recorder) StreamEnd() {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if err := recorder.closeMuxer(); err != nil {
+		fmt.Printf("Recorder close err:%+v\r\n", err)
+	}
+}
+
+func (recorder *Recorder) openMuxer(first *Sample) error {
+	name, path := recorder.newFilePath("castx", recorder.format)
+	muxer, err := recorder.createMuxer(path, recorder.format, first)
+	if err != nil {
+		return err
+	}
+	recorder.muxer = muxer
+	recorder.params = first.Params
+	recorder.fileName = name
+	fmt.Printf("Recorder start file:%s\r\n", path)
+	return nil
+}
+
+// 生成不重名的文件名
+func (recorder *Recorder) newFilePath(prefix string, format string) (string, string) {
+	now := time.Now().Format("20060102-150405")
+	name := fmt.Sprintf("%s-%s.%s", prefix, now, format)
+	path := filepath.Join(recorder.dir(), name)
+	for i := 1; ; i++ {
+		//其他错误(例如目录不可用)也停止,由创建文件时报错
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		name = fmt.Sprintf("%s-%s-%d.%s", prefix, now, i, format)
+		path = filepath.Join(recorder.dir(), name)
+	}
+	return name, path
+}
+
+// 按格式创建封装,first必须是关键帧
+func (recorder *Recorder) createMuxer(path string, format string, first *Sample) (recordMuxer, error) {
+	width, height := videoSize(recorder.config, first)
+	if format == "mp4" {
+		return newMp4FileMuxer(path, first, width, height, recorder.webrtcServer.OpusHead())
+	}
+	return newMkvFileMuxer(path, first, width, height, recorder.webrtcServer.OpusHead())
+}
+
+// 封装用的画面尺寸,h264优先从sps解析
+func videoSize(config *Config, first *Sample) (int, int) {
+	info := config.Info()
+	width, height := info.VideoWidth, info.VideoHeight
+	if strings.EqualFold(first.MimeType, webrtc.MimeTypeH264) && len(first.Params) > 0 {
+		if info, err := ParseSPS(first.Params[0]); err == nil && info.Width > 0 {
+			width, height = info.Width, info.Height
+		}
+	}
+	return width, height
+}
+
+// 已完成的录制文件,正在写的文件不在列表里
+func (recorder *Recorder) List() ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(recorder.dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RecordingInfo{}, nil
+		}
+		return nil, err
+	}
+	current := recorder.FileName()
+	list := []RecordingInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == current || !strings.HasPrefix(entry.Name(), "castx-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, RecordingInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime().UnixMilli()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ModTime > list[j].ModTime })
+	return list, nil
+}
+
+// mp4录制文件,每个GOP或者每秒写一个分片,中途断电也能播放已写入的部分
+type mp4FileMuxer struct {
+	file  *os.File
+	muxer *fmp4Muxer
+	video []*Sample
+	audio []*Sample
+}
+
+func newMp4FileMuxer(path string, first *Sample, width int, height int, opusHead *OpusHead) (*mp4FileMuxer, error) {
+	muxer, err := newFmp4Muxer(first, width, height, true, opusHead)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(muxer.initSegment()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &mp4FileMuxer{file: file, muxer: muxer}, nil
+}
+
+func (mp4File *mp4FileMuxer) WriteSample(sample *Sample) error {
+	if sample.Audio {
+		if sample.Timestamp >= mp4File.muxer.baseTime {
+			mp4File.audio = append(mp4File.audio, sample)
+		}
+		return nil
+	}
+	if len(mp4File.video) > 0 && (sample.KeyFrame || sample.Timestamp-mp4File.video[0].Timestamp >= 1000000) {
+		if err := mp4File.flush(sample.Timestamp); err != nil {
+			return err
+		}
+	}
+	mp4File.video = append(mp4File.video, sample)
+	return nil
+}
+
+func (mp4File *mp4FileMuxer) flush(videoEnd int64) error {
+	if len(mp4File.video) == 0 {
+		return nil
+	}
+	_, err := mp4File.file.Write(mp4File.muxer.fragment(mp4File.video, videoEnd, mp4File.audio))
+	mp4File.video = nil
+	mp4File.audio = nil
+	return err
+}
+
+func (mp4File *mp4FileMuxer) Close() error {
+	if len(mp4File.video) > 0 {
+		last := mp4File.video[len(mp4File.video)-1]
+		mp4File.flush(last.Timestamp + int64(last.Duration/time.Microsecond))
+	}
+	return mp4File.file.Close()
+}
+
+/*
+POST /api/devices/{id}/record/start?format=mp4|mkv|webm
+POST /api/devices/{id}/record/stop
+*/
+func (wsServer *WsServer) handleRecord(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	var err error
+	switch r.PathValue("action") {
+	case "start":
+		err = wsServer.recorder.Start(r.URL.Query().Get("format"))
+	case "stop":
+		err = wsServer.recorder.Stop()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"code": 1, "msg": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, wsServer.recordStatus())
+}
+
+// GET /api/recordings
+func (wsServer *WsServer) handleRecordingList(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	list, err := wsServer.recorder.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "recordings": list})
+}
+
+// GET /api/recordings/{name}
+func (wsServer *WsServer) handleRecordingDownload(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	name := filepath.Base(r.PathValue("name"))
+	if !strings.HasPrefix(name, "castx-") || name == wsServer.recorder.FileName() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, filepath.Join(wsServer.recorder.dir(), name))
+}
+
+func (wsServer *WsServer) recordStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"code":      0,
+		"recording": wsServer.recorder.Recording(),
+		"file":      wsServer.recorder.FileName(),
+		"error":     wsServer.recorder.LastError(),
+	}
+}
@@ -0,0 +1,291 @@
+package comm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	relaySource   = "relay"
+	relayRetryMin = time.Second
+	relayRetryMax = 30 * time.Second
+)
+
+/*
+级联中继:通过WHEP拉取另一个castX的画面,送进本机WebrtcServer再转发给更多观看端
+本机观看端的控制消息经上游websocket转发,请求关键帧时向上游发PLI,断线后自动重连
+*/
+type Relay struct {
+	upstream     string //上游地址,例如 http://192.168.1.10:8081
+	password     string
+	streamToken  string //上游WHEP的Bearer token
+	config       *Config
+	wsServer     *WsServer
+	webrtcServer *WebrtcServer
+	mu           sync.Mutex
+	receive      *WebrtcReceive
+	conn         *websocket.Conn
+	stop         chan struct{}
+	wg           sync.WaitGroup
+	keyFrameCall func()                       //中继前的关键帧请求回调,Close时恢复
+	controlCall  func(map[string]interface{}) //中继前的控制回调,Close时恢复
+}
+
+// streamToken为上游设置的StreamToken,为空时用password
+func StartRelay(upstream string, password string, streamToken string, wsServer *WsServer) (*Relay, error) {
+	upstreamUrl, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamUrl.Scheme != "http" && upstreamUrl.Scheme != "https" {
+		return nil, errors.New("relay upstream must be http or https")
+	}
+	//和WHIP、本地来源互斥
+	if err := wsServer.webrtcServer.acquireSource(relaySource); err != nil {
+		return nil, err
+	}
+	relay := &Relay{
+		upstream:     strings.TrimSuffix(upstream, "/"),
+		password:     password,
+		streamToken:  streamToken,
+		config:       wsServer.config,
+		wsServer:     wsServer,
+		webrtcServer: wsServer.webrtcServer,
+		stop:         make(chan struct{}),
+	}
+	relay.keyFrameCall = relay.webrtcServer.SetKeyFrameRequestFun(relay.requestKeyFrame)
+	relay.controlCall = wsServer.SetControlFun(relay.sendControl)
+	relay.wg.Add(2)
+	go relay.mediaLoop()
+	go relay.controlLoop()
+	return relay, nil
+}
+
+func (relay *Relay) Close() {
+	close(relay.stop)
+	relay.mu.Lock()
+	if relay.conn != nil {
+		relay.conn.Close()
+	}
+	relay.mu.Unlock()
+	relay.wg.Wait()
+	relay.webrtcServer.SetKeyFrameRequestFun(relay.keyFrameCall)
+	relay.wsServer.SetControlFun(relay.controlCall)
+	relay.webrtcServer.releaseSource(relaySource)
+}
+
+// 等待重试,关闭时返回false
+func (relay *Relay) wait(retry *time.Duration) bool {
+	select {
+	case <-relay.stop:
+		return false
+	case <-time.After(*retry):
+	}
+	*retry = min(*retry*2, relayRetryMax)
+	return true
+}
+
+// 拉流,断开后重连
+func (relay *Relay) mediaLoop() {
+	defer relay.wg.Done()
+	retry := relayRetryMin
+	for {
+		if start := time.Now(); relay.pull() && time.Since(start) > relayRetryMax {
+			retry = relayRetryMin
+		}
+		if !relay.wait(&retry) {
+			return
+		}
+	}
+}
+
+// 一次拉流会话,连接断开或者关闭时返回,成功连接过返回true
+func (relay *Relay) pull() bool {
+	//上游的SR拿不到,音视频按各自第一个包的到达时间对齐
+	clock := &mediaClock{}
+	video := &whipVideoWriter{webrtcServer: relay.webrtcServer, source: relaySource, clock: clock.track(90000)}
+	audioClock := clock.track(48000)
+	lost := make(chan struct{})
+	var lostOnce sync.Once
+	receive := &WebrtcReceive{}
+	if len(relay.streamToken) > 0 {
+		receive.SetToken(relay.streamToken)
+	} else {
+		receive.SetToken(relay.password)
+	}
+	receive.SetIceServers(relay.config.IceServerList())
+	if iceTransport, err := relay.webrtcServer.IceTransport(); err == nil {
+		receive.SetIceTransport(iceTransport)
+	}
+	receive.SetReceiveCall(func(cmd int, data []byte, timestamp int64) {
+		if cmd == ReceiveCmdAudio {
+			relay.webrtcServer.sendAudioFrom(relaySource, data, audioClock.timestamp(uint32(timestamp)))
+			return
+		}
+		video.writeNalu(cmd, data, timestamp)
+	})
+	receive.SetFrameEndCall(video.flush)
+	receive.SetCloseCall(func() { lostOnce.Do(func() { close(lost) }) })
+	if err := receive.StartWebRtcReceive(relay.upstream+"/whep", false); err != nil {
+		fmt.Printf("relay pull err:%+v\r\n", err)
+		return false
+	}
+	relay.mu.Lock()
+	relay.receive = receive
+	relay.mu.Unlock()
+	fmt.Printf("relay pull %s\r\n", relay.upstream)
+	select {
+	case <-relay.stop:
+	case <-lost:
+	}
+	relay.mu.Lock()
+	relay.receive = nil
+	relay.mu.Unlock()
+	receive.Close()
+	relay.webrtcServer.StreamEnd()
+	return true
+}
+
+func (relay *Relay) requestKeyFrame() {
+	relay.mu.Lock()
+	receive := relay.receive
+	relay.mu.Unlock()
+	if receive != nil {
+		receive.RequestKeyFrame()
+	}
+}
+
+// 控制消息原样转给上游,格式和网页端一致
+func (relay *Relay) sendControl(data map[string]interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if relay.conn != nil {
+		relay.conn.WriteJSON(WSMessage{Type: MsgTypeControl, Data: string(body)})
+	}
+}
+
+// 上游websocket,登录后转发控制消息并同步屏幕信息,断开后重连
+func (relay *Relay) controlLoop() {
+	defer relay.wg.Done()
+	retry := relayRetryMin
+	for {
+		if start := time.Now(); relay.control() && time.Since(start) > relayRetryMax {
+			retry = relayRetryMin
+		}
+		if !relay.wait(&retry) {
+			return
+		}
+	}
+}
+
+func (relay *Relay) control() bool {
+	wsUrl := "ws" + strings.TrimPrefix(relay.upstream, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		fmt.Printf("relay control err:%+v\r\n", err)
+		return false
+	}
+	defer conn.Close()
+	if err := relay.login(conn); err != nil {
+		fmt.Printf("relay control err:%+v\r\n", err)
+		return false
+	}
+	relay.mu.Lock()
+	select {
+	case <-relay.stop:
+		relay.mu.Unlock()
+		return true
+	default:
+	}
+	relay.conn = conn
+	relay.mu.Unlock()
+	defer func() {
+		relay.mu.Lock()
+		relay.conn = nil
+		relay.mu.Unlock()
+	}()
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return true
+		}
+		if msg.Type == MsgTypeInfoNotify {
+			relay.updateInfo(msg.Data)
+		}
+	}
+}
+
+// 和网页端一样的登录流程,token=sha256(securityKey|timestamp|password)
+func (relay *Relay) login(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var initMsg WSMessage
+	if err := conn.ReadJSON(&initMsg); err != nil {
+		return err
+	}
+	initData, _ := initMsg.Data.(map[string]interface{})
+	securityKey, _ := initData["securityKey"].(string)
+	if initMsg.Type != MsgTypeInitConfig || len(securityKey) == 0 {
+		return errors.New("relay upstream no init config")
+	}
+	timestamp := time.Now().UnixMilli()
+	sum := sha256.Sum256([]byte(securityKey + "|" + strconv.FormatInt(timestamp, 10) + "|" + relay.password))
+	login, _ := json.Marshal(map[string]interface{}{"token": hex.EncodeToString(sum[:]), "timestamp": timestamp})
+	if err := conn.WriteJSON(WSMessage{Type: MsgTypeLoginAuth, Data: string(login)}); err != nil {
+		return err
+	}
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if msg.Type != MsgTypeLoginAuthResp {
+			continue
+		}
+		if resp, _ := msg.Data.(map[string]interface{}); resp["auth"] != true {
+			return errors.New("relay upstream auth fail")
+		}
+		return nil
+	}
+}
+
+// 上游屏幕尺寸和方向同步到本机,观看端按这个换算触控坐标
+func (relay *Relay) updateInfo(data interface{}) {
+	info, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	getInt := func(key string, value *int) {
+		if v, ok := info[key].(float64); ok {
+			*value = int(v)
+		}
+	}
+	relay.config.UpdateInfo(func(screen *ScreenInfo) {
+		getInt("width", &screen.ScreenWidth)
+		getInt("height", &screen.ScreenHeight)
+		getInt("videoWidth", &screen.VideoWidth)
+		getInt("videoHeight", &screen.VideoHeight)
+		getInt("orientation", &screen.Orientation)
+		if v, ok := info["useAdb"].(bool); ok {
+			screen.UseAdb = v
+		}
+		if v, ok := info["adbConnect"].(bool); ok {
+			screen.AdbConnect = v
+		}
+	})
+	relay.wsServer.BroadcastInfo()
+}
@@ -0,0 +1,323 @@
+package comm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/flexfec"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultNackBufferSize = 1024
+	fecMediaPackets       = 5 //每5个视频包发一个fec包
+	mimeTypeRtx           = "video/rtx"
+	mimeTypeFlexFec       = "video/flexfec-03"
+	flexFecPayloadType    = 118
+)
+
+/*
+丢包修复,替换pion默认的nack应答
+观看端发来NACK时从发送缓存里取出原始包重传,协商了rtx时按RFC 4588封装后用单独的ssrc发送,
+否则直接在原ssrc上重传;Config.Fec为flexfec并且对端支持flexfec-03时,视频额外发送前向纠错包
+rtx/fec的ssrc在answer里用ssrc-group声明
+*/
+type repairParams struct {
+	ssrc            uint32 //媒体ssrc
+	rtxSSRC         uint32
+	rtxPayloadTypes map[uint8]uint8 //媒体payload type -> rtx payload type
+	fecSSRC         uint32
+	fecPayloadType  uint8
+}
+
+type repairInterceptorFactory struct {
+	webrtcServer *WebrtcServer
+	bufferSize   int
+}
+
+// 创建PeerConnection时同步调用,调用方持有newPeerMu
+func (factory *repairInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	repair := &repairInterceptor{
+		bufferSize: factory.bufferSize,
+		params:     make(map[uint32]*repairParams),
+		streams:    make(map[uint32]*repairStream),
+	}
+	factory.webrtcServer.newRepair = repair
+	return repair, nil
+}
+
+type repairInterceptor struct {
+	interceptor.NoOp
+	bufferSize int
+	mu         sync.Mutex
+	params     map[uint32]*repairParams //媒体ssrc -> rtx/fec参数
+	streams    map[uint32]*repairStream
+}
+
+type repairStream struct {
+	mu             sync.Mutex
+	writer         interceptor.RTPWriter
+	packets        []*rtp.Packet //按序号取模保存最近发送的包
+	rtxSSRC        uint32
+	rtxPayloadType uint8
+	rtxSeq         uint16
+	fecEncoder     *flexfec.FlexEncoder03
+	fecBuffer      []rtp.Packet
+}
+
+func (repair *repairInterceptor) setParams(ssrc uint32, params *repairParams) {
+	repair.mu.Lock()
+	defer repair.mu.Unlock()
+	repair.params[ssrc] = params
+}
+
+func (repair *repairInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		packets, err := attr.GetRTCPPackets(b[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, packet := range packets {
+			if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				repair.mu.Lock()
+				stream := repair.streams[nack.MediaSSRC]
+				repair.mu.Unlock()
+				if stream != nil {
+					for _, pair := range nack.Nacks {
+						for _, seq := range pair.PacketList() {
+							stream.resend(seq)
+						}
+					}
+				}
+			}
+		}
+		return n, attr, nil
+	})
+}
+
+func (repair *repairInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := &repairStream{writer: writer, packets: make([]*rtp.Packet, repair.bufferSize)}
+	repair.mu.Lock()
+	if params := repair.params[info.SSRC]; params != nil {
+		if rtxPayloadType, ok := params.rtxPayloadTypes[info.PayloadType]; ok && params.rtxSSRC != 0 {
+			stream.rtxSSRC = params.rtxSSRC
+			stream.rtxPayloadType = rtxPayloadType
+		}
+		if params.fecSSRC != 0 {
+			stream.fecEncoder = flexfec.NewFlexEncoder03(params.fecPayloadType, params.fecSSRC)
+		}
+	}
+	repair.streams[info.SSRC] = stream
+	repair.mu.Unlock()
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		stream.save(header, payload)
+		n, err := writer.Write(header, payload, attributes)
+		stream.writeFec(header, payload, attributes)
+		return n, err
+	})
+}
+
+func (repair *repairInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	repair.mu.Lock()
+	defer repair.mu.Unlock()
+	delete(repair.streams, info.SSRC)
+}
+
+func (stream *repairStream) save(header *rtp.Header, payload []byte) {
+	packet := &rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)}
+	stream.mu.Lock()
+	stream.packets[int(header.SequenceNumber)%len(stream.packets)] = packet
+	stream.mu.Unlock()
+}
+
+// 重传,协商了rtx时负载前加上原始序号
+func (stream *repairStream) resend(seq uint16) {
+	stream.mu.Lock()
+	packet := stream.packets[int(seq)%len(stream.packets)]
+	if packet == nil || packet.SequenceNumber != seq {
+		stream.mu.Unlock()
+		return
+	}
+	header := packet.Header.Clone()
+	payload := packet.Payload
+	//twcc序号已经用过,重传包不再带扩展头
+	header.Extension = false
+	header.Extensions = nil
+	if stream.rtxSSRC != 0 {
+		header.SSRC = stream.rtxSSRC
+		header.PayloadType = stream.rtxPayloadType
+		header.SequenceNumber = stream.rtxSeq
+		stream.rtxSeq++
+		payload = append([]byte{byte(seq >> 8), byte(seq)}, packet.Payload...)
+	}
+	stream.mu.Unlock()
+	stream.writer.Write(&header, payload, nil)
+}
+
+func (stream *repairStream) writeFec(header *rtp.Header, payload []byte, attributes interceptor.Attributes) {
+	if stream.fecEncoder == nil {
+		return
+	}
+	stream.mu.Lock()
+	stream.fecBuffer = append(stream.fecBuffer, rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)})
+	if len(stream.fecBuffer) < fecMediaPackets {
+		stream.mu.Unlock()
+		return
+	}
+	fecPackets := stream.fecEncoder.EncodeFec(stream.fecBuffer, 1)
+	stream.fecBuffer = nil
+	stream.mu.Unlock()
+	for i := range fecPackets {
+		fecPackets[i].Timestamp = header.Timestamp
+		stream.writer.Write(&fecPackets[i].Header, fecPackets[i].Payload, attributes)
+	}
+}
+
+// 注册观看端连接用的拦截器,代替pion默认的nack应答
+func (webrtcServer *WebrtcServer) registerInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	config := webrtcServer.config
+	if config == nil {
+		config = &Config{}
+	}
+	bufferSize := config.NackBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultNackBufferSize
+	}
+	if config.Fec == "flexfec" {
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeFlexFec, ClockRate: 90000, SDPFmtpLine: "repair-window=10000000"},
+			PayloadType:        flexFecPayloadType,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	//最先注册,离网络最近,带宽估计只按ssrc转发登记过的流,rtx/fec包要绕过它
+	registry.Add(&repairInterceptorFactory{webrtcServer: webrtcServer, bufferSize: bufferSize})
+	if err := webrtcServer.registerCongestionControl(mediaEngine, registry); err != nil {
+		return err
+	}
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return err
+	}
+	return webrtc.ConfigureTWCCSender(mediaEngine, registry)
+}
+
+// 根据协商结果登记视频的rtx/fec参数,要在SetLocalDescription之前调用,对端都不支持时返回nil
+func (webrtcServer *WebrtcServer) setupRepair(repair *repairInterceptor, sender *webrtc.RTPSender) *repairParams {
+	parameters := sender.GetParameters()
+	if repair == nil || len(parameters.Encodings) == 0 {
+		return nil
+	}
+	config := webrtcServer.config
+	if config == nil {
+		config = &Config{}
+	}
+	params := &repairParams{ssrc: uint32(parameters.Encodings[0].SSRC), rtxPayloadTypes: make(map[uint8]uint8)}
+	for _, codec := range parameters.Codecs {
+		switch {
+		case strings.EqualFold(codec.MimeType, mimeTypeRtx):
+			if apt, ok := strings.CutPrefix(codec.SDPFmtpLine, "apt="); ok {
+				if pt, err := strconv.Atoi(apt); err == nil {
+					params.rtxPayloadTypes[uint8(pt)] = uint8(codec.PayloadType)
+				}
+			}
+		case config.Fec == "flexfec" && strings.EqualFold(codec.MimeType, mimeTypeFlexFec):
+			params.fecSSRC = randUint32()
+			params.fecPayloadType = uint8(codec.PayloadType)
+		}
+	}
+	if len(params.rtxPayloadTypes) > 0 && !config.NoRtx {
+		params.rtxSSRC = randUint32()
+	}
+	if params.rtxSSRC == 0 && params.fecSSRC == 0 {
+		return nil
+	}
+	repair.setParams(params.ssrc, params)
+	return params
+}
+
+// 在视频媒体段里声明rtx(FID)和fec(FEC-FR)的ssrc,pion不允许修改本地sdp,只加在发给对端的answer里
+func addSSRCGroups(answer string, params *repairParams) string {
+	if params == nil {
+		return answer
+	}
+	data, err := params.addSSRCGroups(answer)
+	if err != nil {
+		fmt.Printf("addSSRCGroups err:%+v\r\n", err)
+		return answer
+	}
+	return data
+}
+
+func (params *repairParams) addSSRCGroups(answer string) (string, error) {
+	ssrc := params.ssrc
+	description := &sdp.SessionDescription{}
+	if err := description.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+	prefix := strconv.FormatUint(uint64(ssrc), 10) + " "
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		//复制媒体ssrc的cname/msid等属性
+		var values []string
+		for _, attribute := range media.Attributes {
+			if attribute.Key == "ssrc" && strings.HasPrefix(attribute.Value, prefix) {
+				values = append(values, strings.TrimPrefix(attribute.Value, prefix))
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		for _, group := range []struct {
+			semantics string
+			ssrc      uint32
+		}{{"FID", params.rtxSSRC}, {"FEC-FR", params.fecSSRC}} {
+			if group.ssrc == 0 {
+				continue
+			}
+			media.WithValueAttribute("ssrc-group", fmt.Sprintf("%s %d %d", group.semantics, ssrc, group.ssrc))
+			for _, value := range values {
+				media.WithValueAttribute("ssrc", fmt.Sprintf("%d %s", group.ssrc, value))
+			}
+		}
+		data, err := description.Marshal()
+		return string(data), err
+	}
+	return answer, nil
+}
+
+/*
+WebrtcReceive等接收端的拦截器,丢包时发NACK请求重传
+pion v3从rtx流还原的包不会记进接收记录,限制同一个包的请求次数,避免一直请求
+*/
+func registerReceiveInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	generator, err := nack.NewGeneratorInterceptor(nack.GeneratorMaxNacksPerPacket(3))
+	if err != nil {
+		return err
+	}
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	registry.Add(generator)
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return err
+	}
+	return webrtc.ConfigureTWCCSender(mediaEngine, registry)
+}
@@ -0,0 +1,186 @@
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+/*
+即时回放,内存里保留最近N秒的编码数据,按GOP保存,保证保存出来的文件从关键帧开始
+*/
+type ReplayBuffer struct {
+	config   *Config
+	recorder *Recorder
+	mu       sync.Mutex
+	running  bool
+	seconds  int
+	maxBytes int
+	gops     [][]*Sample
+	size     int
+	overflow bool //当前GOP超出内存上限,丢弃到下一个关键帧
+}
+
+func NewReplayBuffer(config *Config, recorder *Recorder) *ReplayBuffer {
+	return &ReplayBuffer{config: config, recorder: recorder}
+}
+
+// 开始缓存,seconds<=0时使用配置的ReplaySeconds
+func (replay *ReplayBuffer) Start(seconds int) {
+	if seconds <= 0 {
+		seconds = replay.config.ReplaySeconds
+	}
+	if seconds <= 0 {
+		seconds = 60
+	}
+	maxBytes := replay.config.ReplayMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 64 * 1024 * 1024
+	}
+	replay.mu.Lock()
+	replay.seconds = seconds
+	replay.maxBytes = maxBytes
+	running := replay.running
+	replay.running = true
+	replay.mu.Unlock()
+	if !running {
+		replay.recorder.webrtcServer.AddSink(replay)
+	}
+}
+
+func (replay *ReplayBuffer) Stop() {
+	replay.recorder.webrtcServer.RemoveSink(replay)
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+	replay.running = false
+	replay.reset()
+}
+
+func (replay *ReplayBuffer) Running() bool {
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+	return replay.running
+}
+
+func (replay *ReplayBuffer) reset() {
+	replay.gops = nil
+	replay.size = 0
+	replay.overflow = false
+}
+
+func (replay *ReplayBuffer) WriteSample(sample *Sample) {
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+	if !replay.running {
+		return
+	}
+	if !sample.Audio && sample.KeyFrame {
+		//分辨率变化后旧数据无法和新数据写进同一个文件
+		if len(replay.gops) > 0 && !sameParams(replay.gops[0][0].Params, sample.Params) {
+			replay.reset()
+		}
+		replay.gops = append(replay.gops, []*Sample{sample})
+		replay.size += sampleSize(sample)
+		replay.overflow = false
+		replay.trim(sample.Timestamp)
+		return
+	}
+	if len(replay.gops) == 0 || replay.overflow {
+		return
+	}
+	last := len(replay.gops) - 1
+	if replay.size+sampleSize(sample) > replay.maxBytes && last == 0 {
+		replay.overflow = true
+		return
+	}
+	replay.gops[last] = append(replay.gops[last], sample)
+	replay.size += sampleSize(sample)
+	if !sample.Audio {
+		replay.trim(sample.Timestamp)
+	}
+}
+
+// 去掉过期或者超出内存上限的GOP,至少保留最新的一个
+func (replay *ReplayBuffer) trim(now int64) {
+	for len(replay.gops) > 1 {
+		expired := replay.gops[1][0].Timestamp <= now-int64(replay.seconds)*1000000
+		if !expired && replay.size <= replay.maxBytes {
+			break
+		}
+		for _, sample := range replay.gops[0] {
+			replay.size -= sampleSize(sample)
+		}
+		replay.gops = replay.gops[1:]
+	}
+}
+
+func sampleSize(sample *Sample) int {
+	size := len(sample.Data)
+	for _, nalu := range sample.Nalus {
+		size += len(nalu)
+	}
+	return size
+}
+
+func (replay *ReplayBuffer) StreamEnd() {
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+	replay.reset()
+}
+
+// 把缓存写入文件,返回文件名
+func (replay *ReplayBuffer) Save(format string) (string, error) {
+	if len(format) == 0 {
+		format = "mp4"
+	}
+	if err := replay.recorder.checkFormat(format); err != nil {
+		return "", err
+	}
+	replay.mu.Lock()
+	if !replay.running {
+		replay.mu.Unlock()
+		return "", errors.New("replay buffer not running")
+	}
+	var samples []*Sample
+	for _, gop := range replay.gops {
+		samples = append(samples, gop...)
+	}
+	replay.mu.Unlock()
+	if len(samples) == 0 {
+		return "", errors.New("replay buffer empty")
+	}
+	if err := os.MkdirAll(replay.recorder.dir(), 0755); err != nil {
+		return "", err
+	}
+	name, path := replay.recorder.newFilePath("castx-replay", format)
+	muxer, err := replay.recorder.createMuxer(path, format, samples[0])
+	if err != nil {
+		return "", err
+	}
+	for _, sample := range samples {
+		if err = muxer.WriteSample(sample); err != nil {
+			muxer.Close()
+			return "", err
+		}
+	}
+	if err = muxer.Close(); err != nil {
+		return "", err
+	}
+	fmt.Printf("Replay saved:%s\r\n", path)
+	return name, nil
+}
+
+// POST /api/devices/{id}/replay/save?format=mp4
+func (wsServer *WsServer) handleSaveReplay(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	name, err := wsServer.replay.Save(r.URL.Query().Get("format"))
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"code": 1, "msg": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"code": 0, "file": name})
+}
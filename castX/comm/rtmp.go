@@ -0,0 +1,896 @@
+package comm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	rtmpHandshakeSize = 1536
+	rtmpChunkSize     = 4096
+	rtmpTimeout       = 10 * time.Second
+
+	rtmpCsidControl = 2
+	rtmpCsidCommand = 3
+	rtmpCsidAudio   = 4
+	rtmpCsidData    = 5
+	rtmpCsidVideo   = 6
+
+	rtmpMsgSetChunkSize = 1
+	rtmpMsgUserControl  = 4
+	rtmpMsgAudio        = 8
+	rtmpMsgVideo        = 9
+	rtmpMsgData         = 18
+	rtmpMsgCommand      = 20
+)
+
+/*
+rtmp/rtmps推流,作为SampleSink挂在WebrtcServer上,和webrtc共用同一份数据
+h264用标准flv封装,h265和opus音频用enhanced rtmp(FourCC hvc1/Opus)
+连接断开后按1s到30s退避重连,重连后从关键帧开始
+*/
+type RtmpPublisher struct {
+	config       *Config
+	webrtcServer *WebrtcServer
+	mu           sync.Mutex
+	running      bool
+	url          string
+	audio        bool
+	conn         *rtmpConn   //正在握手或者推流的连接
+	stream       *rtmpStream //publish成功后才有
+	lastErr      string
+	stop         chan struct{}
+	wg           sync.WaitGroup
+}
+
+func NewRtmpPublisher(config *Config, webrtcServer *WebrtcServer) *RtmpPublisher {
+	return &RtmpPublisher{config: config, webrtcServer: webrtcServer}
+}
+
+// 开始推流,rawUrl例如 rtmp://127.0.0.1/live/streamKey,audio为true时带上opus音轨
+func (publisher *RtmpPublisher) Start(rawUrl string, audio bool) error {
+	if _, err := parseRtmpUrl(rawUrl); err != nil {
+		return err
+	}
+	mimeType := publisher.webrtcServer.MimeType()
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH264) && !strings.EqualFold(mimeType, webrtc.MimeTypeH265) {
+		return errors.New("rtmp unsupported codec " + mimeType)
+	}
+	publisher.mu.Lock()
+	if publisher.running {
+		publisher.mu.Unlock()
+		return errors.New("already publishing")
+	}
+	publisher.running = true
+	publisher.url = rawUrl
+	publisher.audio = audio
+	publisher.lastErr = ""
+	publisher.stop = make(chan struct{})
+	publisher.mu.Unlock()
+	publisher.wg.Add(1)
+	go publisher.loop(rawUrl, publisher.stop)
+	publisher.webrtcServer.AddSink(publisher)
+	return nil
+}
+
+func (publisher *RtmpPublisher) Stop() error {
+	publisher.mu.Lock()
+	if !publisher.running {
+		publisher.mu.Unlock()
+		return errors.New("not publishing")
+	}
+	publisher.running = false
+	close(publisher.stop)
+	if publisher.conn != nil {
+		publisher.conn.Close()
+	}
+	publisher.mu.Unlock()
+	publisher.webrtcServer.RemoveSink(publisher)
+	publisher.wg.Wait()
+	return nil
+}
+
+func (publisher *RtmpPublisher) Running() bool {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	return publisher.running
+}
+
+// 推流状态,地址里不带推流码
+func (publisher *RtmpPublisher) Status() map[string]interface{} {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	server := ""
+	if rtmpUrl, err := parseRtmpUrl(publisher.url); err == nil {
+		server = rtmpUrl.tcUrl
+	}
+	return map[string]interface{}{
+		"code":       0,
+		"running":    publisher.running,
+		"publishing": publisher.stream != nil,
+		"url":        server,
+		"audio":      publisher.audio,
+		"error":      publisher.lastErr,
+	}
+}
+
+// 推流,断开后重连,直到Stop
+func (publisher *RtmpPublisher) loop(rawUrl string, stop chan struct{}) {
+	defer publisher.wg.Done()
+	retry := relayRetryMin
+	for {
+		start := time.Now()
+		err := publisher.publish(rawUrl, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			fmt.Printf("rtmp publish err:%+v\r\n", err)
+			publisher.mu.Lock()
+			publisher.lastErr = err.Error()
+			publisher.mu.Unlock()
+		}
+		if time.Since(start) > relayRetryMax {
+			retry = relayRetryMin
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, relayRetryMax)
+	}
+}
+
+// 一次推流会话,连接断开或者关闭时返回
+func (publisher *RtmpPublisher) publish(rawUrl string, stop chan struct{}) error {
+	rtmpUrl, err := parseRtmpUrl(rawUrl)
+	if err != nil {
+		return err
+	}
+	conn, err := dialRtmp(rtmpUrl)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	publisher.mu.Lock()
+	select {
+	case <-stop:
+		publisher.mu.Unlock()
+		return nil
+	default:
+	}
+	publisher.conn = conn
+	audio := publisher.audio
+	publisher.mu.Unlock()
+	defer func() {
+		publisher.mu.Lock()
+		publisher.conn = nil
+		publisher.stream = nil
+		publisher.mu.Unlock()
+	}()
+	hevc := strings.EqualFold(publisher.webrtcServer.MimeType(), webrtc.MimeTypeH265)
+	streamId, err := conn.startPublish(rtmpUrl, hevc, audio)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rtmp publish %s\r\n", rtmpUrl.tcUrl)
+	publisher.mu.Lock()
+	publisher.stream = &rtmpStream{
+		conn:     conn,
+		streamId: streamId,
+		hevc:     hevc,
+		audio:    audio,
+		config:   publisher.config,
+		opusHead: publisher.webrtcServer.OpusHead(),
+	}
+	publisher.lastErr = ""
+	publisher.mu.Unlock()
+	publisher.webrtcServer.RequestKeyFrame()
+	//服务端只会发控制消息,读到错误说明连接断了
+	for {
+		msg, err := conn.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg.typeId == rtmpMsgCommand {
+			if err := rtmpStatusError(msg.payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (publisher *RtmpPublisher) WriteSample(sample *Sample) {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if publisher.stream == nil {
+		return
+	}
+	if err := publisher.stream.writeSample(sample); err != nil {
+		//关闭连接,读循环返回后重连
+		publisher.lastErr = err.Error()
+		publisher.stream.conn.Close()
+		publisher.stream = nil
+	}
+}
+
+// 设备断开,下一个关键帧重新发送序列头,时间戳接着之前的继续
+func (publisher *RtmpPublisher) StreamEnd() {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if publisher.stream != nil {
+		publisher.stream.started = false
+	}
+}
+
+// publish成功后的一路流
+type rtmpStream struct {
+	conn        *rtmpConn
+	streamId    uint32
+	hevc        bool
+	audio       bool
+	config      *Config
+	opusHead    *OpusHead
+	started     bool
+	params      [][]byte
+	baseTime    int64  //第一个关键帧的时间戳,微秒
+	lastTime    uint32 //最后发送的时间戳,毫秒
+	sentHeader  bool   //发过metadata
+	audioHeader bool
+}
+
+func (stream *rtmpStream) timestamp(sampleTime int64) uint32 {
+	return uint32((sampleTime - stream.baseTime) / 1000)
+}
+
+func (stream *rtmpStream) writeSample(sample *Sample) error {
+	if sample.Audio {
+		if !stream.audio || !stream.started || sample.Timestamp < stream.baseTime {
+			return nil
+		}
+		if !stream.audioHeader {
+			if err := stream.writeAudio(0, opusIdHeader(stream.opusHead), stream.lastTime); err != nil {
+				return err
+			}
+			stream.audioHeader = true
+		}
+		return stream.writeAudio(1, sample.Data, stream.timestamp(sample.Timestamp))
+	}
+	if sample.KeyFrame && (!stream.started || !sameParams(stream.params, sample.Params)) {
+		if checkParams(sample.MimeType, sample.Params) != nil {
+			return nil
+		}
+		if !stream.started {
+			//重新开始时接着上一次的时间戳,保证单调递增
+			resume := int64(0)
+			if stream.sentHeader {
+				resume = int64(stream.lastTime) + 1
+			}
+			stream.baseTime = sample.Timestamp - resume*1000
+		}
+		if !stream.sentHeader {
+			if err := stream.writeMetadata(sample); err != nil {
+				return err
+			}
+			stream.sentHeader = true
+		}
+		if err := stream.writeVideo(true, true, stream.decoderConfig(sample.Params), stream.timestamp(sample.Timestamp)); err != nil {
+			return err
+		}
+		stream.params = sample.Params
+		stream.started = true
+	}
+	if !stream.started {
+		return nil
+	}
+	return stream.writeVideo(sample.KeyFrame, false, sample.LengthPrefixed(), stream.timestamp(sample.Timestamp))
+}
+
+func (stream *rtmpStream) decoderConfig(params [][]byte) []byte {
+	if stream.hevc {
+		return hevcDecoderConfig(params)
+	}
+	return avcDecoderConfig(params)
+}
+
+// flv视频tag,h265用enhanced rtmp的CodedFramesX(不带cts)
+func (stream *rtmpStream) writeVideo(keyFrame bool, sequenceHeader bool, data []byte, timestamp uint32) error {
+	frameType := byte(2)
+	if keyFrame {
+		frameType = 1
+	}
+	var buf []byte
+	if stream.hevc {
+		packetType := byte(3)
+		if sequenceHeader {
+			packetType = 0
+		}
+		buf = append(buf, 0x80|frameType<<4|packetType, 'h', 'v', 'c', '1')
+	} else {
+		packetType := byte(1)
+		if sequenceHeader {
+			packetType = 0
+		}
+		buf = append(buf, frameType<<4|7, packetType, 0, 0, 0)
+	}
+	stream.lastTime = timestamp
+	return stream.conn.writeMessage(rtmpCsidVideo, rtmpMsgVideo, stream.streamId, timestamp, append(buf, data...))
+}
+
+// enhanced rtmp音频tag,packetType 0:SequenceStart 1:CodedFrames
+func (stream *rtmpStream) writeAudio(packetType byte, data []byte, timestamp uint32) error {
+	buf := append([]byte{9<<4 | packetType}, 'O', 'p', 'u', 's')
+	return stream.conn.writeMessage(rtmpCsidAudio, rtmpMsgAudio, stream.streamId, timestamp, append(buf, data...))
+}
+
+func (stream *rtmpStream) writeMetadata(first *Sample) error {
+	width, height := videoSize(stream.config, first)
+	metadata := amf0EcmaArray{
+		"width":        float64(width),
+		"height":       float64(height),
+		"videocodecid": float64(7),
+		"encoder":      "castX",
+	}
+	if stream.hevc {
+		metadata["videocodecid"] = float64(binary.BigEndian.Uint32([]byte("hvc1")))
+	}
+	if stream.audio {
+		metadata["audiocodecid"] = float64(binary.BigEndian.Uint32([]byte("Opus")))
+	}
+	return stream.conn.writeMessage(rtmpCsidData, rtmpMsgData, stream.streamId, 0, amf0Encode("@setDataFrame", "onMetaData", metadata))
+}
+
+// RFC 7845的OpusHead,enhanced rtmp的Opus序列头
+func opusIdHeader(head *OpusHead) []byte {
+	channels, preSkip, sampleRate, gain := opusParams(head)
+	buf := append([]byte("OpusHead"), 1, channels)
+	buf = binary.LittleEndian.AppendUint16(buf, preSkip)
+	buf = binary.LittleEndian.AppendUint32(buf, sampleRate)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(gain))
+	return append(buf, 0)
+}
+
+type rtmpUrl struct {
+	host  string //带端口
+	tls   bool
+	app   string
+	key   string
+	tcUrl string
+}
+
+// rtmp://host[:port]/app/key,最后一段(带query)是推流码,前面的都是app
+func parseRtmpUrl(rawUrl string) (*rtmpUrl, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	result := &rtmpUrl{}
+	port := "1935"
+	switch u.Scheme {
+	case "rtmp":
+	case "rtmps":
+		result.tls = true
+		port = "443"
+	default:
+		return nil, errors.New("rtmp url must be rtmp or rtmps")
+	}
+	if len(u.Port()) > 0 {
+		port = u.Port()
+	}
+	path := strings.Trim(u.Path, "/")
+	index := strings.LastIndex(path, "/")
+	if len(u.Hostname()) == 0 || index <= 0 || index == len(path)-1 {
+		return nil, errors.New("rtmp url need app and stream key")
+	}
+	result.host = net.JoinHostPort(u.Hostname(), port)
+	result.app = path[:index]
+	result.key = path[index+1:]
+	if len(u.RawQuery) > 0 {
+		result.key += "?" + u.RawQuery
+	}
+	result.tcUrl = u.Scheme + "://" + u.Host + "/" + result.app
+	return result, nil
+}
+
+// 分块流的接收状态
+type rtmpChunk struct {
+	length   uint32
+	typeId   byte
+	streamId uint32
+	extended bool
+	payload  []byte
+}
+
+type rtmpMessage struct {
+	typeId   byte
+	streamId uint32
+	payload  []byte
+}
+
+// rtmp连接,只实现推流需要的部分
+type rtmpConn struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	writeMu       sync.Mutex
+	readChunkSize int
+	chunks        map[uint32]*rtmpChunk
+}
+
+func dialRtmp(rtmpUrl *rtmpUrl) (*rtmpConn, error) {
+	dialer := &net.Dialer{Timeout: rtmpTimeout}
+	var conn net.Conn
+	var err error
+	if rtmpUrl.tls {
+		host, _, _ := net.SplitHostPort(rtmpUrl.host)
+		conn, err = tls.DialWithDialer(dialer, "tcp", rtmpUrl.host, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", rtmpUrl.host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rtmp := &rtmpConn{conn: conn, reader: bufio.NewReader(conn), readChunkSize: 128, chunks: map[uint32]*rtmpChunk{}}
+	conn.SetDeadline(time.Now().Add(rtmpTimeout))
+	if err := rtmp.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rtmp, nil
+}
+
+func (rtmp *rtmpConn) Close() error {
+	return rtmp.conn.Close()
+}
+
+// 简单握手 C0C1 -> S0S1S2 -> C2
+func (rtmp *rtmpConn) handshake() error {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	c0c1[0] = 3
+	rand.Read(c0c1[9:])
+	if _, err := rtmp.conn.Write(c0c1); err != nil {
+		return err
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(rtmp.reader, s0s1s2); err != nil {
+		return err
+	}
+	if s0s1s2[0] != 3 {
+		return fmt.Errorf("rtmp unsupported version %d", s0s1s2[0])
+	}
+	_, err := rtmp.conn.Write(s0s1s2[1 : 1+rtmpHandshakeSize])
+	return err
+}
+
+// connect,createStream,publish,返回消息流id
+func (rtmp *rtmpConn) startPublish(rtmpUrl *rtmpUrl, hevc bool, audio bool) (uint32, error) {
+	rtmp.conn.SetDeadline(time.Now().Add(rtmpTimeout))
+	defer rtmp.conn.SetDeadline(time.Time{})
+	if err := rtmp.writeMessage(rtmpCsidControl, rtmpMsgSetChunkSize, 0, 0, be32(rtmpChunkSize)); err != nil {
+		return 0, err
+	}
+	connect := map[string]interface{}{
+		"app":      rtmpUrl.app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; castX)",
+		"tcUrl":    rtmpUrl.tcUrl,
+	}
+	//enhanced rtmp要声明用到的FourCC
+	var fourCcList []interface{}
+	if hevc {
+		fourCcList = append(fourCcList, "hvc1")
+	}
+	if audio {
+		fourCcList = append(fourCcList, "Opus")
+	}
+	if len(fourCcList) > 0 {
+		connect["fourCcList"] = fourCcList
+	}
+	if _, err := rtmp.call(0, "connect", 1, connect); err != nil {
+		return 0, err
+	}
+	rtmp.writeCommand(0, "releaseStream", 2, nil, rtmpUrl.key)
+	rtmp.writeCommand(0, "FCPublish", 3, nil, rtmpUrl.key)
+	result, err := rtmp.call(0, "createStream", 4, nil)
+	if err != nil {
+		return 0, err
+	}
+	streamId, ok := result[len(result)-1].(float64)
+	if !ok {
+		return 0, errors.New("rtmp createStream no stream id")
+	}
+	if err := rtmp.writeCommand(uint32(streamId), "publish", 5, nil, rtmpUrl.key, "live"); err != nil {
+		return 0, err
+	}
+	//等待NetStream.Publish.Start
+	for {
+		msg, err := rtmp.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if msg.typeId != rtmpMsgCommand {
+			continue
+		}
+		if err := rtmpStatusError(msg.payload); err != nil {
+			return 0, err
+		}
+		values, _ := amf0Decode(msg.payload)
+		if len(values) >= 4 && values[0] == "onStatus" {
+			if info, _ := values[3].(map[string]interface{}); info["code"] == "NetStream.Publish.Start" {
+				return uint32(streamId), nil
+			}
+		}
+	}
+}
+
+func (rtmp *rtmpConn) writeCommand(streamId uint32, name string, transactionId float64, args ...interface{}) error {
+	values := append([]interface{}{name, transactionId}, args...)
+	return rtmp.writeMessage(rtmpCsidCommand, rtmpMsgCommand, streamId, 0, amf0Encode(values...))
+}
+
+// 发送命令并等待对应事务的_result
+func (rtmp *rtmpConn) call(streamId uint32, name string, transactionId float64, args ...interface{}) ([]interface{}, error) {
+	if err := rtmp.writeCommand(streamId, name, transactionId, args...); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := rtmp.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.typeId != rtmpMsgCommand {
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) < 2 || values[1] != transactionId {
+			continue
+		}
+		switch values[0] {
+		case "_result":
+			return values, nil
+		case "_error":
+			return nil, fmt.Errorf("rtmp %s fail:%v", name, values[len(values)-1])
+		}
+	}
+}
+
+// onStatus里level为error时返回错误,例如推流码错误
+func rtmpStatusError(payload []byte) error {
+	values, err := amf0Decode(payload)
+	if err != nil || len(values) < 4 || values[0] != "onStatus" {
+		return nil
+	}
+	info, _ := values[3].(map[string]interface{})
+	if info["level"] == "error" {
+		return fmt.Errorf("rtmp %v %v", info["code"], info["description"])
+	}
+	return nil
+}
+
+// 每条消息都用type0头,超过块大小的部分用type3头续传
+func (rtmp *rtmpConn) writeMessage(csid byte, typeId byte, streamId uint32, timestamp uint32, payload []byte) error {
+	extended := timestamp >= 0xFFFFFF
+	header := []byte{csid}
+	if extended {
+		header = append(header, 0xFF, 0xFF, 0xFF)
+	} else {
+		header = append(header, byte(timestamp>>16), byte(timestamp>>8), byte(timestamp))
+	}
+	length := len(payload)
+	header = append(header, byte(length>>16), byte(length>>8), byte(length), typeId)
+	header = binary.LittleEndian.AppendUint32(header, streamId)
+	if extended {
+		header = binary.BigEndian.AppendUint32(header, timestamp)
+	}
+	buf := make([]byte, 0, len(header)+length+length/rtmpChunkSize*5)
+	buf = append(buf, header...)
+	for offset := 0; offset < length; offset += rtmpChunkSize {
+		if offset > 0 {
+			buf = append(buf, 0xC0|csid)
+			if extended {
+				buf = binary.BigEndian.AppendUint32(buf, timestamp)
+			}
+		}
+		buf = append(buf, payload[offset:min(offset+rtmpChunkSize, length)]...)
+	}
+	rtmp.writeMu.Lock()
+	defer rtmp.writeMu.Unlock()
+	rtmp.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := rtmp.conn.Write(buf)
+	return err
+}
+
+// 读一条完整的消息,块大小和ping在这里处理
+func (rtmp *rtmpConn) readMessage() (*rtmpMessage, error) {
+	for {
+		b, err := rtmp.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := b >> 6
+		csid := uint32(b & 0x3F)
+		if csid < 2 {
+			ext := make([]byte, csid+1)
+			if _, err := io.ReadFull(rtmp.reader, ext); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(ext[0])
+			if len(ext) == 2 {
+				csid += uint32(ext[1]) * 256
+			}
+		}
+		chunk := rtmp.chunks[csid]
+		if chunk == nil {
+			chunk = &rtmpChunk{}
+			rtmp.chunks[csid] = chunk
+		}
+		header := make([]byte, []int{11, 7, 3, 0}[format])
+		if _, err := io.ReadFull(rtmp.reader, header); err != nil {
+			return nil, err
+		}
+		if format <= 2 {
+			chunk.extended = header[0] == 0xFF && header[1] == 0xFF && header[2] == 0xFF
+		}
+		if format <= 1 {
+			chunk.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			chunk.typeId = header[6]
+		}
+		if format == 0 {
+			chunk.streamId = binary.LittleEndian.Uint32(header[7:11])
+		}
+		if chunk.extended {
+			if _, err := io.ReadFull(rtmp.reader, make([]byte, 4)); err != nil {
+				return nil, err
+			}
+		}
+		size := min(int(chunk.length)-len(chunk.payload), rtmp.readChunkSize)
+		data := make([]byte, size)
+		if _, err := io.ReadFull(rtmp.reader, data); err != nil {
+			return nil, err
+		}
+		chunk.payload = append(chunk.payload, data...)
+		if len(chunk.payload) < int(chunk.length) {
+			continue
+		}
+		msg := &rtmpMessage{typeId: chunk.typeId, streamId: chunk.streamId, payload: chunk.payload}
+		chunk.payload = nil
+		switch msg.typeId {
+		case rtmpMsgSetChunkSize:
+			if len(msg.payload) >= 4 {
+				rtmp.readChunkSize = int(binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF)
+			}
+			continue
+		case rtmpMsgUserControl:
+			//PingRequest回PingResponse
+			if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == 6 {
+				reply := append(be16(7), msg.payload[2:6]...)
+				if err := rtmp.writeMessage(rtmpCsidControl, rtmpMsgUserControl, 0, 0, reply); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// amf0的ecma array,用于onMetaData
+type amf0EcmaArray map[string]interface{}
+
+func amf0Encode(values ...interface{}) []byte {
+	var buf []byte
+	for _, value := range values {
+		buf = amf0Append(buf, value)
+	}
+	return buf
+}
+
+func amf0Append(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0x05)
+	case float64:
+		buf = append(buf, 0x00)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	case int:
+		return amf0Append(buf, float64(v))
+	case bool:
+		if v {
+			return append(buf, 0x01, 1)
+		}
+		return append(buf, 0x01, 0)
+	case string:
+		if len(v) > 0xFFFF {
+			buf = append(buf, 0x0C)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+			return append(buf, v...)
+		}
+		buf = append(buf, 0x02)
+		return amf0AppendKey(buf, v)
+	case map[string]interface{}:
+		return amf0AppendProperties(append(buf, 0x03), v)
+	case amf0EcmaArray:
+		buf = append(buf, 0x08)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		return amf0AppendProperties(buf, v)
+	case []interface{}:
+		buf = append(buf, 0x0A)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		for _, item := range v {
+			buf = amf0Append(buf, item)
+		}
+		return buf
+	}
+	return append(buf, 0x06)
+}
+
+func amf0AppendKey(buf []byte, key string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+	return append(buf, key...)
+}
+
+// 属性按key排序,最后是空key加结束标记
+func amf0AppendProperties(buf []byte, properties map[string]interface{}) []byte {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf = amf0AppendKey(buf, key)
+		buf = amf0Append(buf, properties[key])
+	}
+	return append(buf, 0, 0, 0x09)
+}
+
+// 解码amf0,对象和ecma array都解成map
+func amf0Decode(data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		value, n, err := amf0DecodeValue(data)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+var errAmf0Short = errors.New("amf0 data too short")
+
+func amf0DecodeValue(data []byte) (interface{}, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errAmf0Short
+	}
+	switch data[0] {
+	case 0x00:
+		if len(data) < 9 {
+			return nil, 0, errAmf0Short
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 9, nil
+	case 0x01:
+		if len(data) < 2 {
+			return nil, 0, errAmf0Short
+		}
+		return data[1] != 0, 2, nil
+	case 0x02:
+		key, n, err := amf0DecodeKey(data[1:])
+		return key, 1 + n, err
+	case 0x03:
+		properties, n, err := amf0DecodeProperties(data[1:])
+		return properties, 1 + n, err
+	case 0x05, 0x06:
+		return nil, 1, nil
+	case 0x08:
+		if len(data) < 5 {
+			return nil, 0, errAmf0Short
+		}
+		properties, n, err := amf0DecodeProperties(data[5:])
+		return properties, 5 + n, err
+	case 0x0A:
+		if len(data) < 5 {
+			return nil, 0, errAmf0Short
+		}
+		count := int(binary.BigEndian.Uint32(data[1:5]))
+		offset := 5
+		var items []interface{}
+		for i := 0; i < count; i++ {
+			item, n, err := amf0DecodeValue(data[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset += n
+		}
+		return items, offset, nil
+	case 0x0C:
+		if len(data) < 5 {
+			return nil, 0, errAmf0Short
+		}
+		size := int(binary.BigEndian.Uint32(data[1:5]))
+		if len(data) < 5+size {
+			return nil, 0, errAmf0Short
+		}
+		return string(data[5 : 5+size]), 5 + size, nil
+	}
+	return nil, 0, fmt.Errorf("amf0 unsupported type %d", data[0])
+}
+
+func amf0DecodeKey(data []byte) (string, int, error) {
+	if len(data) < 2 {
+		return "", 0, errAmf0Short
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+size {
+		return "", 0, errAmf0Short
+	}
+	return string(data[2 : 2+size]), 2 + size, nil
+}
+
+func amf0DecodeProperties(data []byte) (map[string]interface{}, int, error) {
+	properties := map[string]interface{}{}
+	offset := 0
+	for {
+		key, n, err := amf0DecodeKey(data[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		if len(key) == 0 && offset < len(data) && data[offset] == 0x09 {
+			return properties, offset + 1, nil
+		}
+		value, n, err := amf0DecodeValue(data[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		properties[key] = value
+		offset += n
+	}
+}
+
+/*
+POST /api/devices/{id}/rtmp/start?url=rtmp://host/app/key&audio=1
+POST /api/devices/{id}/rtmp/stop
+GET /api/devices/{id}/rtmp
+url也可以放在表单里,避免推流码出现在访问日志
+*/
+func (wsServer *WsServer) handleRtmp(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	var err error
+	switch r.PathValue("action") {
+	case "":
+	case "start":
+		err = wsServer.rtmp.Start(r.FormValue("url"), r.FormValue("audio") == "1")
+	case "stop":
+		err = wsServer.rtmp.Stop()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"code": 1, "msg": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, wsServer.rtmp.Status())
+}
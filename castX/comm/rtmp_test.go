@@ -0,0 +1,205 @@
+package comm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// 进程内的rtmp服务端,只处理一次推流,publishCode为publish的应答
+type testRtmpServer struct {
+	listener    net.Listener
+	publishCode string
+	conn        *rtmpConn
+	done        chan error
+	messages    chan *rtmpMessage //publish之后收到的音视频和metadata
+}
+
+func newTestRtmpServer(t *testing.T, publishCode string) *testRtmpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testRtmpServer{listener: listener, publishCode: publishCode, done: make(chan error, 1), messages: make(chan *rtmpMessage, 16)}
+	go func() {
+		server.done <- server.serve()
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+func (server *testRtmpServer) url(app string, key string) string {
+	return fmt.Sprintf("rtmp://%s/%s/%s", server.listener.Addr(), app, key)
+}
+
+func (server *testRtmpServer) serve() error {
+	conn, err := server.listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	server.conn = &rtmpConn{conn: conn, reader: bufio.NewReader(conn), readChunkSize: 128, chunks: map[uint32]*rtmpChunk{}}
+	//C0C1 -> S0S1S2,S2原样返回C1
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(server.conn.reader, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("version %d", c0c1[0])
+	}
+	s0s1s2 := append([]byte{3}, make([]byte, rtmpHandshakeSize)...)
+	if _, err := conn.Write(append(s0s1s2, c0c1[1:]...)); err != nil {
+		return err
+	}
+	c2 := make([]byte, rtmpHandshakeSize)
+	if _, err := io.ReadFull(server.conn.reader, c2); err != nil {
+		return err
+	}
+	if !bytes.Equal(c2[8:], make([]byte, rtmpHandshakeSize-8)) {
+		return fmt.Errorf("c2 is not s1")
+	}
+
+	values, err := server.expectCommand("connect", 0)
+	if err != nil {
+		return err
+	}
+	if info, _ := values[2].(map[string]interface{}); info["app"] != "live/room" || !strings.HasSuffix(info["tcUrl"].(string), "/live/room") {
+		return fmt.Errorf("connect %v", values[2])
+	}
+	server.conn.writeMessage(rtmpCsidControl, rtmpMsgSetChunkSize, 0, 0, be32(rtmpChunkSize))
+	server.conn.writeCommand(0, "_result", values[1].(float64), nil, map[string]interface{}{"level": "status", "code": "NetConnection.Connect.Success"})
+	for _, name := range []string{"releaseStream", "FCPublish"} {
+		if _, err := server.expectCommand(name, 0); err != nil {
+			return err
+		}
+	}
+	values, err = server.expectCommand("createStream", 0)
+	if err != nil {
+		return err
+	}
+	server.conn.writeCommand(0, "_result", values[1].(float64), nil, float64(1))
+	values, err = server.expectCommand("publish", 1)
+	if err != nil {
+		return err
+	}
+	if values[3] != "key?token=1" || values[4] != "live" {
+		return fmt.Errorf("publish %v", values)
+	}
+	level := "status"
+	if server.publishCode != "NetStream.Publish.Start" {
+		level = "error"
+	}
+	server.conn.writeCommand(1, "onStatus", 0, nil, map[string]interface{}{"level": level, "code": server.publishCode, "description": "test"})
+	for {
+		msg, err := server.conn.readMessage()
+		if err != nil {
+			return nil
+		}
+		server.messages <- msg
+	}
+}
+
+func (server *testRtmpServer) expectCommand(name string, streamId uint32) ([]interface{}, error) {
+	msg, err := server.conn.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	values, err := amf0Decode(msg.payload)
+	if err != nil {
+		return nil, err
+	}
+	if msg.typeId != rtmpMsgCommand || msg.streamId != streamId || len(values) < 3 || values[0] != name {
+		return nil, fmt.Errorf("want %s on stream %d, got %v on stream %d", name, streamId, values, msg.streamId)
+	}
+	return values, nil
+}
+
+func (server *testRtmpServer) next(t *testing.T) *rtmpMessage {
+	select {
+	case msg := <-server.messages:
+		return msg
+	case err := <-server.done:
+		t.Fatalf("server done:%v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestRtmpPublish(t *testing.T) {
+	server := newTestRtmpServer(t, "NetStream.Publish.Start")
+	rtmpUrl, err := parseRtmpUrl(server.url("live/room", "key?token=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialRtmp(rtmpUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	streamId, err := conn.startPublish(rtmpUrl, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamId != 1 {
+		t.Fatalf("stream id %d", streamId)
+	}
+
+	stream := &rtmpStream{conn: conn, streamId: streamId, config: &Config{}}
+	params := [][]byte{{0x67, 0x42, 0xc0, 0x1f, 0xda}, {0x68, 0xce, 0x3c, 0x80}}
+	//超过块大小,服务端要按type3块拼回
+	frame := append([]byte{0x65}, bytes.Repeat([]byte{1}, rtmpChunkSize*2)...)
+	samples := []*Sample{
+		{MimeType: webrtc.MimeTypeH264, KeyFrame: true, Timestamp: 1000000, Params: params, Nalus: [][]byte{frame}},
+		{MimeType: webrtc.MimeTypeH264, Timestamp: 1040000, Params: params, Nalus: [][]byte{{0x41, 2}}},
+	}
+	for _, sample := range samples {
+		if err := stream.writeSample(sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := server.next(t)
+	if values, _ := amf0Decode(msg.payload); msg.typeId != rtmpMsgData || len(values) < 2 || values[1] != "onMetaData" {
+		t.Fatalf("metadata %v", values)
+	}
+	//AVC序列头,关键帧,后面两帧的时间戳相对第一个关键帧
+	msg = server.next(t)
+	if msg.typeId != rtmpMsgVideo || msg.streamId != 1 || !bytes.Equal(msg.payload[:2], []byte{0x17, 0}) {
+		t.Fatalf("sequence header % x", msg.payload[:min(len(msg.payload), 8)])
+	}
+	msg = server.next(t)
+	if !bytes.Equal(msg.payload[:2], []byte{0x17, 1}) || !bytes.Equal(msg.payload[5:], samples[0].LengthPrefixed()) {
+		t.Fatalf("key frame len %d", len(msg.payload))
+	}
+	msg = server.next(t)
+	if !bytes.Equal(msg.payload[:2], []byte{0x27, 1}) || stream.lastTime != 40 {
+		t.Fatalf("frame % x time %d", msg.payload, stream.lastTime)
+	}
+}
+
+func TestRtmpPublishRejected(t *testing.T) {
+	server := newTestRtmpServer(t, "NetStream.Publish.BadName")
+	rtmpUrl, err := parseRtmpUrl(server.url("live/room", "key?token=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialRtmp(rtmpUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.startPublish(rtmpUrl, false, false); err == nil || !strings.Contains(err.Error(), "NetStream.Publish.BadName") {
+		t.Fatalf("want BadName, got %v", err)
+	}
+}
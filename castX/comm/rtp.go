@@ -0,0 +1,57 @@
+package comm
+
+import (
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// h265 rtp打包(RFC 7798),单nalu或者FU分片,pion v3没有提供
+type h265Payloader struct{}
+
+func (p *h265Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	var payloads [][]byte
+	for _, nalu := range splitNalus(payload) {
+		if len(nalu) < 3 {
+			continue
+		}
+		if len(nalu) <= int(mtu) {
+			payloads = append(payloads, append([]byte(nil), nalu...))
+			continue
+		}
+		naluType := (nalu[0] >> 1) & 0x3F
+		header := []byte{(nalu[0] & 0x81) | (49 << 1), nalu[1]}
+		data := nalu[2:]
+		maxSize := int(mtu) - 3
+		for start := 0; start < len(data); start += maxSize {
+			end := min(start+maxSize, len(data))
+			fuHeader := naluType
+			if start == 0 {
+				fuHeader |= 0x80
+			}
+			if end == len(data) {
+				fuHeader |= 0x40
+			}
+			packet := append([]byte{header[0], header[1], fuHeader}, data[start:end]...)
+			payloads = append(payloads, packet)
+		}
+	}
+	return payloads
+}
+
+// 按编码选择rtp打包器
+func newPayloader(mimeType string) rtp.Payloader {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &codecs.H264Payloader{}
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return &h265Payloader{}
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return &codecs.AV1Payloader{}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return &codecs.OpusPayloader{}
+	}
+	return nil
+}
@@ -0,0 +1,605 @@
+package comm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	rtspVideoTrack   = 0
+	rtspAudioTrack   = 1
+	rtspVideoPayload = 96
+	rtspAudioPayload = 97
+	rtspMtu          = 1200
+	rtspSRInterval   = 5 * time.Second //发送端报告间隔
+	ntpEpochOffset   = 2208988800      //1900到1970的秒数
+)
+
+/*
+rtsp服务,和webrtc共用同一份样本数据,rtp只打包一次再分发给所有会话
+支持OPTIONS/DESCRIBE/SETUP/PLAY/TEARDOWN,传输方式支持tcp交织和udp
+地址 rtsp://ip:port/default 或 rtsp://ip:port/设备名
+*/
+type RtspServer struct {
+	config          *Config
+	webrtcServer    *WebrtcServer
+	listener        net.Listener
+	mu              sync.Mutex
+	sessions        map[*rtspSession]struct{}
+	params          [][]byte
+	hasAudio        bool
+	videoPacketizer rtp.Packetizer
+	audioPacketizer rtp.Packetizer
+	videoSSRC       uint32
+	audioSSRC       uint32
+	ntpBase         time.Time //样本时间轴和墙上时间的对应关系,音视频共用,SR按它换算ntp
+	ntpBaseTs       int64
+	hasNtpBase      bool
+}
+
+type rtspPacket struct {
+	track   int
+	data    []byte
+	rtpTime uint32
+	ntpTime uint64 //这个包的rtp时间戳对应的ntp时间
+}
+
+// 每个轨道发送统计,用于发送端报告
+type rtspTrackStat struct {
+	packets uint32
+	octets  uint32
+	lastSR  time.Time
+	rtpTime uint32
+	ntpTime uint64
+}
+
+// 一个rtsp控制连接对应一个会话
+type rtspSession struct {
+	id           string
+	conn         net.Conn
+	writeMu      sync.Mutex
+	tcp          bool
+	channels     map[int]int //track -> 交织通道
+	udpConns     map[int]*net.UDPConn
+	udpAddrs     map[int]*net.UDPAddr
+	rtcpConns    map[int]*net.UDPConn //rtp端口+1
+	rtcpAddrs    map[int]*net.UDPAddr
+	ssrc         map[int]uint32
+	playing      bool
+	waitKeyFrame bool
+	queue        chan *rtspPacket
+	closeOnce    sync.Once
+}
+
+type rtspRequest struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func StartRtsp(port int, config *Config, webrtcServer *WebrtcServer) (*RtspServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	rtspServer := &RtspServer{
+		config:       config,
+		webrtcServer: webrtcServer,
+		listener:     listener,
+		sessions:     make(map[*rtspSession]struct{}),
+		videoSSRC:    randUint32(),
+		audioSSRC:    randUint32(),
+	}
+	if payloader := newPayloader(webrtcServer.MimeType()); payloader != nil {
+		rtspServer.videoPacketizer = rtp.NewPacketizer(rtspMtu, rtspVideoPayload, rtspServer.videoSSRC, payloader, rtp.NewRandomSequencer(), 90000)
+	}
+	rtspServer.audioPacketizer = rtp.NewPacketizer(rtspMtu, rtspAudioPayload, rtspServer.audioSSRC, newPayloader(webrtc.MimeTypeOpus), rtp.NewRandomSequencer(), 48000)
+	webrtcServer.AddSink(rtspServer)
+	fmt.Printf("StartRtsp port:%d\r\n", port)
+	go rtspServer.accept()
+	return rtspServer, nil
+}
+
+func (rtspServer *RtspServer) Shutdown() {
+	rtspServer.listener.Close()
+	rtspServer.webrtcServer.RemoveSink(rtspServer)
+	rtspServer.mu.Lock()
+	sessions := rtspServer.sessions
+	rtspServer.sessions = make(map[*rtspSession]struct{})
+	rtspServer.mu.Unlock()
+	for session := range sessions {
+		session.close()
+	}
+}
+
+func (rtspServer *RtspServer) accept() {
+	for {
+		conn, err := rtspServer.listener.Accept()
+		if err != nil {
+			return
+		}
+		go rtspServer.handleConn(conn)
+	}
+}
+
+func (rtspServer *RtspServer) WriteSample(sample *Sample) {
+	var packets []*rtp.Packet
+	track := rtspVideoTrack
+	ntpTime := rtspServer.ntpTime(sample.Timestamp)
+	if sample.Audio {
+		track = rtspAudioTrack
+		rtspServer.mu.Lock()
+		rtspServer.hasAudio = true
+		rtspServer.mu.Unlock()
+		packets = rtspServer.audioPacketizer.Packetize(sample.Data, 0)
+		for _, packet := range packets {
+			packet.Timestamp = uint32(sample.Timestamp * 48 / 1000)
+		}
+	} else {
+		if sample.KeyFrame {
+			rtspServer.mu.Lock()
+			rtspServer.params = sample.Params
+			rtspServer.mu.Unlock()
+		}
+		if rtspServer.videoPacketizer == nil {
+			return
+		}
+		//关键帧前带上参数集,客户端不依赖sdp也能解码
+		packets = rtspServer.videoPacketizer.Packetize(sample.AnnexB(true), 0)
+		for _, packet := range packets {
+			packet.Timestamp = uint32(sample.Timestamp * 90 / 1000)
+		}
+	}
+	datas := make([]*rtspPacket, 0, len(packets))
+	for _, packet := range packets {
+		data, err := packet.Marshal()
+		if err == nil {
+			datas = append(datas, &rtspPacket{track: track, data: data, rtpTime: packet.Timestamp, ntpTime: ntpTime})
+		}
+	}
+	rtspServer.mu.Lock()
+	defer rtspServer.mu.Unlock()
+	for session := range rtspServer.sessions {
+		session.push(datas, sample)
+	}
+}
+
+// 样本时间戳(微秒)换算成ntp时间,第一个样本对应当前时间
+func (rtspServer *RtspServer) ntpTime(timestamp int64) uint64 {
+	rtspServer.mu.Lock()
+	defer rtspServer.mu.Unlock()
+	if !rtspServer.hasNtpBase {
+		rtspServer.hasNtpBase = true
+		rtspServer.ntpBase = time.Now()
+		rtspServer.ntpBaseTs = timestamp
+	}
+	wall := rtspServer.ntpBase.Add(time.Duration(timestamp-rtspServer.ntpBaseTs) * time.Microsecond)
+	seconds := uint64(wall.Unix() + ntpEpochOffset)
+	fraction := uint64(wall.Nanosecond()) << 32 / 1000000000
+	return seconds<<32 | fraction
+}
+
+// 设备断开后参数集可能变化,等新的关键帧
+func (rtspServer *RtspServer) StreamEnd() {
+	rtspServer.mu.Lock()
+	defer rtspServer.mu.Unlock()
+	rtspServer.params = nil
+	rtspServer.hasNtpBase = false
+	for session := range rtspServer.sessions {
+		session.waitKeyFrame = true
+	}
+}
+
+func (rtspServer *RtspServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	if isPrivateIPv4(conn.RemoteAddr().String()) == false {
+		return
+	}
+	session := &rtspSession{
+		conn:         conn,
+		channels:     make(map[int]int),
+		udpConns:     make(map[int]*net.UDPConn),
+		udpAddrs:     make(map[int]*net.UDPAddr),
+		rtcpConns:    make(map[int]*net.UDPConn),
+		rtcpAddrs:    make(map[int]*net.UDPAddr),
+		ssrc:         map[int]uint32{rtspVideoTrack: rtspServer.videoSSRC, rtspAudioTrack: rtspServer.audioSSRC},
+		waitKeyFrame: true,
+		queue:        make(chan *rtspPacket, 1024),
+	}
+	defer func() {
+		rtspServer.mu.Lock()
+		delete(rtspServer.sessions, session)
+		rtspServer.mu.Unlock()
+		session.close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := readRtspRequest(reader)
+		if err != nil {
+			return
+		}
+		if !rtspServer.checkAuth(req) {
+			session.writeResponse(req, 401, "Unauthorized", []string{"WWW-Authenticate", `Basic realm="castX"`}, nil)
+			continue
+		}
+		if !rtspServer.checkDevice(req.url) {
+			session.writeResponse(req, 404, "Not Found", nil, nil)
+			continue
+		}
+		switch req.method {
+		case "OPTIONS":
+			session.writeResponse(req, 200, "OK", []string{"Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}, nil)
+		case "DESCRIBE":
+			sdp := rtspServer.sdp(conn.LocalAddr())
+			base := strings.TrimSuffix(req.url, "/") + "/"
+			session.writeResponse(req, 200, "OK", []string{"Content-Type", "application/sdp", "Content-Base", base}, []byte(sdp))
+		case "SETUP":
+			rtspServer.handleSetup(session, req)
+		case "PLAY":
+			if len(session.id) == 0 {
+				session.writeResponse(req, 455, "Method Not Valid in This State", nil, nil)
+				continue
+			}
+			session.writeResponse(req, 200, "OK", []string{"Session", session.id, "Range", "npt=0.000-"}, nil)
+			rtspServer.mu.Lock()
+			if !session.playing {
+				session.playing = true
+				rtspServer.sessions[session] = struct{}{}
+				go session.loop()
+			}
+			rtspServer.mu.Unlock()
+		case "TEARDOWN":
+			session.writeResponse(req, 200, "OK", []string{"Session", session.id}, nil)
+			return
+		case "GET_PARAMETER", "SET_PARAMETER":
+			session.writeResponse(req, 200, "OK", []string{"Session", session.id}, nil)
+		default:
+			session.writeResponse(req, 501, "Not Implemented", nil, nil)
+		}
+	}
+}
+
+func (rtspServer *RtspServer) handleSetup(session *rtspSession, req *rtspRequest) {
+	track := rtspVideoTrack
+	if strings.HasSuffix(req.url, fmt.Sprintf("trackID=%d", rtspAudioTrack)) {
+		track = rtspAudioTrack
+	}
+	transport := req.header.Get("Transport")
+	if len(session.id) == 0 {
+		session.id = randHex(8)
+	}
+	if strings.Contains(transport, "RTP/AVP/TCP") || strings.Contains(transport, "interleaved=") {
+		channel := track * 2
+		if value := transportParam(transport, "interleaved"); len(value) > 0 {
+			channel, _ = strconv.Atoi(strings.Split(value, "-")[0])
+		}
+		session.tcp = true
+		session.channels[track] = channel
+		reply := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+		session.writeResponse(req, 200, "OK", []string{"Transport", reply, "Session", session.id + ";timeout=60"}, nil)
+		return
+	}
+	clientPort := transportParam(transport, "client_port")
+	port, err := strconv.Atoi(strings.Split(clientPort, "-")[0])
+	if session.tcp || err != nil {
+		session.writeResponse(req, 461, "Unsupported Transport", nil, nil)
+		return
+	}
+	remoteIp := session.conn.RemoteAddr().(*net.TCPAddr).IP
+	rtpConn, rtcpConn, err := listenRtpPair()
+	if err != nil {
+		session.writeResponse(req, 500, "Internal Server Error", nil, nil)
+		return
+	}
+	if old, ok := session.udpConns[track]; ok {
+		old.Close()
+		session.rtcpConns[track].Close()
+	}
+	session.udpConns[track] = rtpConn
+	session.udpAddrs[track] = &net.UDPAddr{IP: remoteIp, Port: port}
+	session.rtcpConns[track] = rtcpConn
+	session.rtcpAddrs[track] = &net.UDPAddr{IP: remoteIp, Port: port + 1}
+	//客户端发来的rtcp只接收不处理
+	go io.Copy(io.Discard, rtpConn)
+	go io.Copy(io.Discard, rtcpConn)
+	serverPort := rtpConn.LocalAddr().(*net.UDPAddr).Port
+	reply := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", port, port+1, serverPort, serverPort+1)
+	session.writeResponse(req, 200, "OK", []string{"Transport", reply, "Session", session.id + ";timeout=60"}, nil)
+}
+
+// rtp用偶数端口,rtcp用下一个奇数端口
+func listenRtpPair() (*net.UDPConn, *net.UDPConn, error) {
+	for i := 0; i < 20; i++ {
+		rtpConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtpConn.Close()
+			continue
+		}
+		rtcpConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		return rtpConn, rtcpConn, nil
+	}
+	return nil, nil, errors.New("no rtp port pair")
+}
+
+// 没有设置密码时不校验,否则使用Basic认证,用户名任意
+func (rtspServer *RtspServer) checkAuth(req *rtspRequest) bool {
+	if len(rtspServer.config.Password) == 0 {
+		return true
+	}
+	auth := req.header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return false
+	}
+	_, password, _ := strings.Cut(string(data), ":")
+	return subtle.ConstantTimeCompare([]byte(password), []byte(rtspServer.config.Password)) == 1
+}
+
+func (rtspServer *RtspServer) checkDevice(rawUrl string) bool {
+	if rawUrl == "*" {
+		return true
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	id := strings.Trim(u.Path, "/")
+	if idx := strings.Index(id, "/trackID="); idx >= 0 {
+		id = id[:idx]
+	} else if strings.HasPrefix(id, "trackID=") {
+		id = ""
+	}
+	return len(id) == 0 || rtspServer.config.MatchDevice(id)
+}
+
+func (rtspServer *RtspServer) sdp(localAddr net.Addr) string {
+	rtspServer.mu.Lock()
+	params := rtspServer.params
+	hasAudio := rtspServer.hasAudio || rtspServer.webrtcServer.OpusHead() != nil
+	rtspServer.mu.Unlock()
+	ip := "0.0.0.0"
+	if addr, ok := localAddr.(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		ip = addr.IP.String()
+	}
+	var sb strings.Builder
+	sb.WriteString("v=0\r\n")
+	fmt.Fprintf(&sb, "o=- %d 1 IN IP4 %s\r\n", randUint32(), ip)
+	sb.WriteString("s=castX\r\n")
+	sb.WriteString("c=IN IP4 0.0.0.0\r\n")
+	sb.WriteString("t=0 0\r\n")
+	sb.WriteString("a=control:*\r\n")
+	fmt.Fprintf(&sb, "m=video 0 RTP/AVP %d\r\n", rtspVideoPayload)
+	mimeType := rtspServer.webrtcServer.MimeType()
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		fmt.Fprintf(&sb, "a=rtpmap:%d H265/90000\r\n", rtspVideoPayload)
+		if len(params) == 3 {
+			fmt.Fprintf(&sb, "a=fmtp:%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s\r\n", rtspVideoPayload,
+				base64.StdEncoding.EncodeToString(params[0]),
+				base64.StdEncoding.EncodeToString(params[1]),
+				base64.StdEncoding.EncodeToString(params[2]))
+		}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		fmt.Fprintf(&sb, "a=rtpmap:%d AV1/90000\r\n", rtspVideoPayload)
+	default:
+		fmt.Fprintf(&sb, "a=rtpmap:%d H264/90000\r\n", rtspVideoPayload)
+		fmtp := "packetization-mode=1"
+		if len(params) == 2 && len(params[0]) >= 4 {
+			fmtp += fmt.Sprintf(";profile-level-id=%s;sprop-parameter-sets=%s,%s", hex.EncodeToString(params[0][1:4]),
+				base64.StdEncoding.EncodeToString(params[0]),
+				base64.StdEncoding.EncodeToString(params[1]))
+		}
+		fmt.Fprintf(&sb, "a=fmtp:%d %s\r\n", rtspVideoPayload, fmtp)
+	}
+	fmt.Fprintf(&sb, "a=control:trackID=%d\r\n", rtspVideoTrack)
+	if hasAudio {
+		fmt.Fprintf(&sb, "m=audio 0 RTP/AVP %d\r\n", rtspAudioPayload)
+		fmt.Fprintf(&sb, "a=rtpmap:%d opus/48000/2\r\n", rtspAudioPayload)
+		fmt.Fprintf(&sb, "a=control:trackID=%d\r\n", rtspAudioTrack)
+	}
+	return sb.String()
+}
+
+// 放进发送队列,队列满了丢弃视频直到下一个关键帧
+func (session *rtspSession) push(datas []*rtspPacket, sample *Sample) {
+	if !sample.Audio {
+		if session.waitKeyFrame && !sample.KeyFrame {
+			return
+		}
+		session.waitKeyFrame = false
+	}
+	for _, data := range datas {
+		select {
+		case session.queue <- data:
+		default:
+			if !sample.Audio {
+				session.waitKeyFrame = true
+			}
+			return
+		}
+	}
+}
+
+func (session *rtspSession) loop() {
+	stats := map[int]*rtspTrackStat{rtspVideoTrack: {}, rtspAudioTrack: {}}
+	for packet := range session.queue {
+		stat := stats[packet.track]
+		if !session.write(packet.track, false, packet.data) {
+			return
+		}
+		stat.packets++
+		stat.octets += uint32(len(packet.data) - 12)
+		stat.rtpTime = packet.rtpTime
+		stat.ntpTime = packet.ntpTime
+		//定时发送端报告,客户端按ntp时间同步音视频
+		if time.Since(stat.lastSR) >= rtspSRInterval {
+			stat.lastSR = time.Now()
+			sr := &rtcp.SenderReport{
+				SSRC:        session.ssrc[packet.track],
+				NTPTime:     stat.ntpTime,
+				RTPTime:     stat.rtpTime,
+				PacketCount: stat.packets,
+				OctetCount:  stat.octets,
+			}
+			if data, err := sr.Marshal(); err == nil && !session.write(packet.track, true, data) {
+				return
+			}
+		}
+	}
+}
+
+// 发送rtp或rtcp,tcp时走交织通道(rtcp为rtp通道+1),写失败返回false
+func (session *rtspSession) write(track int, control bool, data []byte) bool {
+	if session.tcp {
+		channel, ok := session.channels[track]
+		if !ok {
+			return true
+		}
+		if control {
+			channel++
+		}
+		buf := make([]byte, 0, len(data)+4)
+		buf = append(buf, '$', byte(channel), byte(len(data)>>8), byte(len(data)))
+		buf = append(buf, data...)
+		session.writeMu.Lock()
+		_, err := session.conn.Write(buf)
+		session.writeMu.Unlock()
+		if err != nil {
+			session.conn.Close()
+			return false
+		}
+		return true
+	}
+	conns, addrs := session.udpConns, session.udpAddrs
+	if control {
+		conns, addrs = session.rtcpConns, session.rtcpAddrs
+	}
+	if udpConn, ok := conns[track]; ok {
+		udpConn.WriteToUDP(data, addrs[track])
+	}
+	return true
+}
+
+func (session *rtspSession) close() {
+	session.closeOnce.Do(func() {
+		close(session.queue)
+		session.conn.Close()
+		for _, udpConn := range session.udpConns {
+			udpConn.Close()
+		}
+		for _, rtcpConn := range session.rtcpConns {
+			rtcpConn.Close()
+		}
+	})
+}
+
+func (session *rtspSession) writeResponse(req *rtspRequest, code int, status string, headers []string, body []byte) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "RTSP/1.0 %d %s\r\n", code, status)
+	fmt.Fprintf(&sb, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	sb.WriteString("Server: castX\r\n")
+	for i := 0; i+1 < len(headers); i += 2 {
+		fmt.Fprintf(&sb, "%s: %s\r\n", headers[i], headers[i+1])
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&sb, "Content-Length: %d\r\n", len(body))
+	}
+	sb.WriteString("\r\n")
+	sb.Write(body)
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	_, err := session.conn.Write([]byte(sb.String()))
+	return err
+}
+
+// 读取一个rtsp请求,跳过客户端发来的交织rtcp包
+func readRtspRequest(reader *bufio.Reader) (*rtspRequest, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		head := make([]byte, 4)
+		if _, err = io.ReadFull(reader, head); err != nil {
+			return nil, err
+		}
+		if _, err = reader.Discard(int(head[2])<<8 | int(head[3])); err != nil {
+			return nil, err
+		}
+	}
+	tp := textproto.NewReader(reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, errors.New("bad rtsp request")
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	req := &rtspRequest{method: parts[0], url: parts[1], header: header}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		req.body = make([]byte, length)
+		if _, err = io.ReadFull(reader, req.body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// 取Transport头里的参数值
+func transportParam(transport string, key string) string {
+	for _, part := range strings.Split(transport, ";") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(part), key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randUint32() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
@@ -0,0 +1,346 @@
+package comm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// 发往录制等输出端的一帧数据
+type Sample struct {
+	MimeType  string
+	Audio     bool
+	KeyFrame  bool
+	Timestamp int64 //微秒
+	Duration  time.Duration
+	Nalus     [][]byte //h264/h265的nalu,不含起始码
+	Data      []byte   //音频包或者av1的obu
+	Params    [][]byte //当前生效的参数集 h264:sps,pps h265:vps,sps,pps av1:sequence header
+}
+
+// 样本接收端,在独立的协程里调用,不会阻塞推流
+type SampleSink interface {
+	WriteSample(sample *Sample)
+}
+
+// 设备断开时通知接收端结束当前流,可选实现
+type StreamEndSink interface {
+	StreamEnd()
+}
+
+/*
+每个接收端一个有界队列,写满后丢弃,直到下一个关键帧再恢复视频,避免解码花屏
+流结束标记不能丢,队列多留一个位置给它,样本最多只占size个
+*/
+type sinkQueue struct {
+	sink         SampleSink
+	ch           chan *Sample //nil表示流结束
+	done         chan struct{}
+	size         int
+	mu           sync.Mutex //音视频可能同时入队
+	waitKeyFrame bool
+}
+
+func newSinkQueue(sink SampleSink, size int) *sinkQueue {
+	queue := &sinkQueue{sink: sink, ch: make(chan *Sample, size+1), done: make(chan struct{}), size: size}
+	go queue.loop()
+	return queue
+}
+
+func (queue *sinkQueue) loop() {
+	defer close(queue.done)
+	for sample := range queue.ch {
+		if sample == nil {
+			if endSink, ok := queue.sink.(StreamEndSink); ok {
+				endSink.StreamEnd()
+			}
+			continue
+		}
+		queue.sink.WriteSample(sample)
+	}
+}
+
+func (queue *sinkQueue) push(sample *Sample) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if sample == nil {
+		//只有最后一个已经是结束标记时才会满,这时不用再放
+		select {
+		case queue.ch <- nil:
+		default:
+		}
+		return
+	}
+	if !sample.Audio {
+		if queue.waitKeyFrame && !sample.KeyFrame {
+			return
+		}
+		queue.waitKeyFrame = false
+	}
+	if len(queue.ch) >= queue.size {
+		if !sample.Audio {
+			queue.waitKeyFrame = true
+		}
+		return
+	}
+	queue.ch <- sample
+}
+
+// 关闭队列并等待剩余数据写完
+func (queue *sinkQueue) close() {
+	close(queue.ch)
+	<-queue.done
+}
+
+// 带起始码的annex-b格式
+func (sample *Sample) AnnexB(withParams bool) []byte {
+	if len(sample.Nalus) == 0 {
+		return sample.Data
+	}
+	buf := new(bytes.Buffer)
+	if withParams && sample.KeyFrame {
+		for _, nalu := range sample.Params {
+			buf.Write([]byte{0x00, 0x00, 0x00, 0x01})
+			buf.Write(nalu)
+		}
+	}
+	for _, nalu := range sample.Nalus {
+		buf.Write([]byte{0x00, 0x00, 0x00, 0x01})
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+// 4字节长度前缀格式(mp4/mkv使用)
+func (sample *Sample) LengthPrefixed() []byte {
+	if len(sample.Nalus) == 0 {
+		return sample.Data
+	}
+	size := 0
+	for _, nalu := range sample.Nalus {
+		size += 4 + len(nalu)
+	}
+	buf := make([]byte, 0, size)
+	for _, nalu := range sample.Nalus {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(nalu)))
+		buf = append(buf, nalu...)
+	}
+	return buf
+}
+
+func sameParams(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 按起始码切分annex-b数据,没有起始码时整个数据当作一个nalu
+func splitNalus(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	i := 0
+	for i+2 < len(data) {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				if end > start && data[end-1] == 0 {
+					end--
+				}
+				if end > start {
+					nalus = append(nalus, data[start:end])
+				}
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start < 0 {
+		if len(data) > 0 {
+			return [][]byte{data}
+		}
+		return nil
+	}
+	if start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+/*
+把SendVideo收到的数据整理成完整帧
+不同来源的数据粒度不一样:scrcpy单独发sps/pps,安卓MediaCodec的配置包sps+pps在一起,ffmpeg按nalu切分,
+这里统一缓存参数集,收到图像数据时输出一帧
+*/
+type videoAssembler struct {
+	mimeType string
+	vps      []byte
+	sps      []byte
+	pps      []byte
+	params   [][]byte
+	pending  [][]byte //sei等非图像nalu,跟随下一帧输出
+}
+
+func newVideoAssembler(mimeType string) *videoAssembler {
+	return &videoAssembler{mimeType: mimeType}
+}
+
+func (assembler *videoAssembler) push(data []byte, timestamp int64, duration time.Duration) *Sample {
+	if len(data) == 0 {
+		return nil
+	}
+	if strings.EqualFold(assembler.mimeType, webrtc.MimeTypeAV1) {
+		return assembler.pushAV1(data, timestamp, duration)
+	}
+	hevc := strings.EqualFold(assembler.mimeType, webrtc.MimeTypeH265)
+	keyFrame := false
+	hasPicture := false
+	paramsChange := false
+	nalus := assembler.pending
+	assembler.pending = nil
+	for _, nalu := range splitNalus(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		nalu = append([]byte(nil), nalu...)
+		if hevc {
+			switch naluType := (nalu[0] >> 1) & 0x3F; {
+			case naluType == 32:
+				paramsChange = paramsChange || !bytes.Equal(assembler.vps, nalu)
+				assembler.vps = nalu
+			case naluType == 33:
+				paramsChange = paramsChange || !bytes.Equal(assembler.sps, nalu)
+				assembler.sps = nalu
+			case naluType == 34:
+				paramsChange = paramsChange || !bytes.Equal(assembler.pps, nalu)
+				assembler.pps = nalu
+			case naluType == 35: //AUD
+			case naluType < 32:
+				hasPicture = true
+				keyFrame = keyFrame || (naluType >= 16 && naluType <= 21)
+				nalus = append(nalus, nalu)
+			default:
+				nalus = append(nalus, nalu)
+			}
+			continue
+		}
+		switch naluType := nalu[0] & 0x1F; {
+		case naluType == 7:
+			paramsChange = paramsChange || !bytes.Equal(assembler.sps, nalu)
+			assembler.sps = nalu
+		case naluType == 8:
+			paramsChange = paramsChange || !bytes.Equal(assembler.pps, nalu)
+			assembler.pps = nalu
+		case naluType == 9: //AUD
+		case naluType >= 1 && naluType <= 5:
+			hasPicture = true
+			keyFrame = keyFrame || naluType == 5
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	//参数集全部收到后才更新,缺的时候沿用之前完整的一组
+	if paramsChange {
+		if hevc && assembler.vps != nil && assembler.sps != nil && assembler.pps != nil {
+			assembler.params = [][]byte{assembler.vps, assembler.sps, assembler.pps}
+		} else if !hevc && assembler.sps != nil && assembler.pps != nil {
+			assembler.params = [][]byte{assembler.sps, assembler.pps}
+		}
+	}
+	if !hasPicture {
+		assembler.pending = nalus
+		return nil
+	}
+	return &Sample{
+		MimeType:  assembler.mimeType,
+		KeyFrame:  keyFrame,
+		Timestamp: timestamp,
+		Duration:  duration,
+		Nalus:     nalus,
+		Params:    assembler.params,
+	}
+}
+
+// av1不分nalu,带sequence header的temporal unit当作关键帧
+func (assembler *videoAssembler) pushAV1(data []byte, timestamp int64, duration time.Duration) *Sample {
+	data = append([]byte(nil), data...)
+	seqHeader := av1SequenceHeader(data)
+	if seqHeader != nil && (assembler.sps == nil || !bytes.Equal(assembler.sps, seqHeader)) {
+		assembler.sps = seqHeader
+		assembler.params = [][]byte{seqHeader}
+	}
+	return &Sample{
+		MimeType:  assembler.mimeType,
+		KeyFrame:  seqHeader != nil,
+		Timestamp: timestamp,
+		Duration:  duration,
+		Data:      data,
+		Params:    assembler.params,
+	}
+}
+
+// 找出av1 temporal unit里的sequence header obu(含obu头)
+func av1SequenceHeader(data []byte) []byte {
+	offset := 0
+	for offset < len(data) {
+		header := data[offset]
+		obuType := (header >> 3) & 0x0F
+		headerSize := 1
+		if header&0x04 != 0 {
+			headerSize++
+		}
+		if header&0x02 == 0 || offset+headerSize > len(data) {
+			return nil
+		}
+		size, n := readLeb128(data[offset+headerSize:])
+		if n == 0 {
+			return nil
+		}
+		end := offset + headerSize + n + int(size)
+		if end > len(data) {
+			return nil
+		}
+		if obuType == 1 {
+			return data[offset:end]
+		}
+		offset = end
+	}
+	return nil
+}
+
+func readLeb128(data []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= uint64(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// 是否是opus配置包(scrcpy的AOPUSHD封装或者裸的OpusHead)
+func isOpusConfig(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("AOPUSHD")) || bytes.HasPrefix(data, []byte("OpusHead"))
+}
+
+// 从opus配置包中解析OpusHead
+func parseOpusConfig(data []byte) *OpusHead {
+	idx := bytes.Index(data, []byte("OpusHead"))
+	if idx < 0 || len(data)-idx < 19 {
+		return nil
+	}
+	return ParseOpusHead(data[idx:])
+}
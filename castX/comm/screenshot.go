@@ -0,0 +1,104 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+/*
+通过adb执行screencap截图,不经过视频流所以不会影响正在进行的投屏
+displayId小于0时使用默认屏幕
+shell可能分配pty改写换行,libadb也没有exec服务,所以先写到设备临时文件,再用sync协议原样拉取
+*/
+func (wsServer *WsServer) Screenshot(displayId int) ([]byte, error) {
+	path := fmt.Sprintf("/data/local/tmp/castx-screenshot-%s.png", randHex(8))
+	cmd := "screencap -p " + path
+	if displayId >= 0 {
+		cmd = fmt.Sprintf("screencap -d %d -p %s", displayId, path)
+	}
+	out, err := wsServer.Shell(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer wsServer.Shell("rm -f " + path)
+	buf := new(bytes.Buffer)
+	if err := wsServer.Pull(path, buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("screencap failed:%s", strings.TrimSpace(out[:min(len(out), 200)]))
+	}
+	return data, nil
+}
+
+// 按最大边长等比缩放png
+func scalePng(data []byte, maxSide int) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return data, nil
+	}
+	if width >= height {
+		height = height * maxSide / width
+		width = maxSide
+	} else {
+		width = width * maxSide / height
+		height = maxSide
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+GET /api/devices/{id}/screenshot.png?display=0&size=320
+size为缩略图最大边长,不传返回原图
+*/
+func (wsServer *WsServer) handleScreenshot(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkHttpAuth(w, r) {
+		return
+	}
+	displayId := -1
+	if display := r.URL.Query().Get("display"); len(display) > 0 {
+		id, err := strconv.Atoi(display)
+		if err != nil {
+			http.Error(w, "invalid display", http.StatusBadRequest)
+			return
+		}
+		displayId = id
+	}
+	data, err := wsServer.Screenshot(displayId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if size, _ := strconv.Atoi(r.URL.Query().Get("size")); size > 0 {
+		data, err = scalePng(data, size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
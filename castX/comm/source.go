@@ -0,0 +1,85 @@
+package comm
+
+import (
+	"errors"
+	"time"
+)
+
+const sourceIdleTime = 3 * time.Second //本地来源多久没有数据才允许WHIP/中继接管
+
+/*
+推流来源同一时间只能有一个
+本地来源(scrcpy、桌面采集、android)直接调用SendVideo/SendAudio/SendWebrtc,
+WHIP推流和级联中继要先acquireSource独占,独占期间本地来源的数据直接丢弃,
+避免两路数据交错写进同一个组帧器和GOP缓存,也避免两边同时接管关键帧请求回调
+*/
+func (webrtcServer *WebrtcServer) acquireSource(owner string) error {
+	webrtcServer.sourceMu.Lock()
+	defer webrtcServer.sourceMu.Unlock()
+	if len(webrtcServer.sourceOwner) > 0 {
+		return errors.New("source busy:" + webrtcServer.sourceOwner)
+	}
+	if !webrtcServer.lastLocalSample.IsZero() && time.Since(webrtcServer.lastLocalSample) < sourceIdleTime {
+		return errors.New("source busy:local")
+	}
+	webrtcServer.sourceOwner = owner
+	webrtcServer.lastVideoTimestamp = 0
+	webrtcServer.lastAudioTimestamp = 0
+	return nil
+}
+
+func (webrtcServer *WebrtcServer) releaseSource(owner string) {
+	webrtcServer.sourceMu.Lock()
+	defer webrtcServer.sourceMu.Unlock()
+	if webrtcServer.sourceOwner == owner {
+		webrtcServer.sourceOwner = ""
+		webrtcServer.lastVideoTimestamp = 0
+		webrtcServer.lastAudioTimestamp = 0
+	}
+}
+
+// 独占来源的视频,已经不是独占者时丢弃
+func (webrtcServer *WebrtcServer) sendVideoFrom(owner string, nal []byte, timestamp int64) {
+	if duration, ok := webrtcServer.sampleDuration(owner, false, timestamp); ok {
+		webrtcServer.sendWebrtc(nal, timestamp, duration, false)
+	}
+}
+
+func (webrtcServer *WebrtcServer) sendAudioFrom(owner string, nal []byte, timestamp int64) {
+	if duration, ok := webrtcServer.sampleDuration(owner, true, timestamp); ok {
+		webrtcServer.sendWebrtc(nal, timestamp, duration, true)
+	}
+}
+
+// owner是当前来源时返回和上一帧的间隔,owner为空表示本地来源
+func (webrtcServer *WebrtcServer) sampleDuration(owner string, audio bool, timestamp int64) (time.Duration, bool) {
+	webrtcServer.sourceMu.Lock()
+	defer webrtcServer.sourceMu.Unlock()
+	if owner != webrtcServer.sourceOwner {
+		return 0, false
+	}
+	if len(owner) == 0 {
+		webrtcServer.lastLocalSample = time.Now()
+	}
+	last := &webrtcServer.lastVideoTimestamp
+	if audio {
+		last = &webrtcServer.lastAudioTimestamp
+	}
+	duration := time.Second / 40
+	if *last != 0 {
+		duration = time.Duration(timestamp-*last) * time.Microsecond
+	}
+	*last = timestamp
+	return duration, true
+}
+
+// 本地来源直接调用SendWebrtc时检查,被独占时返回false
+func (webrtcServer *WebrtcServer) localSource() bool {
+	webrtcServer.sourceMu.Lock()
+	defer webrtcServer.sourceMu.Unlock()
+	if len(webrtcServer.sourceOwner) > 0 {
+		return false
+	}
+	webrtcServer.lastLocalSample = time.Now()
+	return true
+}
@@ -0,0 +1,143 @@
+package comm
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+webrtc被防火墙拦截时的备用输出,通过websocket发送fragmented mp4,网页用MSE播放
+每次(重新)初始化先发一条文本消息{"type":"init","mimeType":"video/mp4; codecs=\"avc1.42e01f\""},
+再发二进制的初始化段,之后每个二进制消息是一帧的moof+mdat,参数集变化时会重新初始化
+*/
+type streamSink struct {
+	conn         *websocket.Conn
+	config       *Config
+	webrtcServer *WebrtcServer
+	audio        bool
+	muxer        *fmp4Muxer
+	video        *Sample //等下一帧确定时长后再发
+	audioSamples []*Sample
+	closed       bool //写失败或超时后关闭连接,读循环退出后RemoveSink
+}
+
+func (sink *streamSink) WriteSample(sample *Sample) {
+	if sink.closed {
+		return
+	}
+	if sample.Audio {
+		if sink.audio && sink.muxer != nil && sample.Timestamp >= sink.muxer.baseTime {
+			sink.audioSamples = append(sink.audioSamples, sample)
+		}
+		return
+	}
+	if sample.KeyFrame && (sink.muxer == nil || !sameParams(sink.muxer.params, sample.Params)) {
+		sink.flush(sample.Timestamp)
+		if !sink.start(sample) {
+			return
+		}
+	}
+	if sink.muxer == nil {
+		return
+	}
+	sink.flush(sample.Timestamp)
+	sink.video = sample
+}
+
+// 设备断开,下一个关键帧重新初始化
+func (sink *streamSink) StreamEnd() {
+	if sink.video != nil {
+		sink.flush(sink.video.Timestamp + int64(sink.video.Duration/time.Microsecond))
+	}
+	sink.muxer = nil
+}
+
+func (sink *streamSink) start(first *Sample) bool {
+	width, height := videoSize(sink.config, first)
+	muxer, err := newFmp4Muxer(first, width, height, sink.audio, sink.webrtcServer.OpusHead())
+	if err != nil {
+		fmt.Printf("stream err:%+v\r\n", err)
+		return false
+	}
+	sink.muxer = muxer
+	sink.audioSamples = nil
+	codecs := mp4CodecString(first.MimeType, first.Params)
+	if sink.audio {
+		codecs += ",opus"
+	}
+	mimeType := fmt.Sprintf(`video/mp4; codecs="%s"`, codecs)
+	sink.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := sink.conn.WriteJSON(map[string]interface{}{"type": "init", "mimeType": mimeType}); err != nil {
+		sink.close()
+		return false
+	}
+	sink.write(muxer.initSegment())
+	return !sink.closed
+}
+
+func (sink *streamSink) flush(videoEnd int64) {
+	if sink.video == nil {
+		return
+	}
+	data := sink.muxer.fragment([]*Sample{sink.video}, videoEnd, sink.audioSamples)
+	sink.video = nil
+	sink.audioSamples = nil
+	sink.write(data)
+}
+
+func (sink *streamSink) write(data []byte) {
+	sink.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := sink.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		sink.close()
+	}
+}
+
+func (sink *streamSink) close() {
+	sink.closed = true
+	sink.conn.Close()
+}
+
+/*
+GET /stream 或 /api/devices/{id}/stream (websocket)
+鉴权和WHEP一致,浏览器可以用query里的token/timestamp,audio=1时带上opus音轨(推流端要有音频,否则MSE会等待音频)
+*/
+func (wsServer *WsServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkBearerAuth(w, r) {
+		return
+	}
+	mimeType := wsServer.webrtcServer.MimeType()
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH264) && !strings.EqualFold(mimeType, webrtc.MimeTypeH265) {
+		http.Error(w, "stream unsupported codec "+mimeType, http.StatusNotAcceptable)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	sink := &streamSink{
+		conn:         conn,
+		config:       wsServer.config,
+		webrtcServer: wsServer.webrtcServer,
+		audio:        r.URL.Query().Get("audio") == "1",
+	}
+	wsServer.webrtcServer.AddSink(sink)
+	//从关键帧开始播放
+	wsServer.webrtcServer.RequestKeyFrame()
+	//读协程用于感知断开
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	conn.Close()
+	wsServer.webrtcServer.RemoveSink(sink)
+}
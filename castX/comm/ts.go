@@ -0,0 +1,302 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	tsPacketSize = 188
+	tsPmtPid     = 0x1000
+	tsVideoPid   = 0x100
+	tsAudioPid   = 0x101
+	tsPtsDelay   = 63000 //pts比pcr超前700ms(90k),给解码器缓冲
+)
+
+/*
+MPEG-TS封装,一个节目,视频h264/h265,音频opus(ETSI TS 102 366附录的私有流)
+每个关键帧前重发PAT/PMT,pcr放在视频包的自适应字段里,由帧的pts换算
+*/
+type tsMuxer struct {
+	hevc       bool
+	audio      bool
+	channels   byte
+	continuity map[uint16]byte
+}
+
+func newTsMuxer(hevc bool, audio bool, opusHead *OpusHead) *tsMuxer {
+	channels, _, _, _ := opusParams(opusHead)
+	return &tsMuxer{hevc: hevc, audio: audio, channels: channels, continuity: map[uint16]byte{}}
+}
+
+// PAT和PMT
+func (muxer *tsMuxer) psi() []byte {
+	pat := []byte{0x00, 0xB0, 0x00, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xE0 | tsPmtPid>>8, tsPmtPid & 0xFF}
+	streamType := byte(0x1B)
+	if muxer.hevc {
+		streamType = 0x24
+	}
+	pmt := []byte{0x02, 0xB0, 0x00, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE0 | tsVideoPid>>8, tsVideoPid & 0xFF, 0xF0, 0x00}
+	pmt = append(pmt, streamType, 0xE0|tsVideoPid>>8, tsVideoPid&0xFF, 0xF0, 0x00)
+	if muxer.audio {
+		//registration_descriptor 'Opus' + extension_descriptor channel_config_code
+		esInfo := []byte{0x05, 0x04, 'O', 'p', 'u', 's', 0x7F, 0x02, 0x80, muxer.channels}
+		pmt = append(pmt, 0x06, 0xE0|tsAudioPid>>8, tsAudioPid&0xFF, 0xF0, byte(len(esInfo)))
+		pmt = append(pmt, esInfo...)
+	}
+	buf := muxer.section(0, pat)
+	return append(buf, muxer.section(tsPmtPid, pmt)...)
+}
+
+// 填上section_length和crc,放进一个ts包
+func (muxer *tsMuxer) section(pid uint16, section []byte) []byte {
+	length := len(section) - 3 + 4
+	section[1] = 0xB0 | byte(length>>8)
+	section[2] = byte(length)
+	section = binary.BigEndian.AppendUint32(section, crc32Mpeg2(section))
+	packet := make([]byte, tsPacketSize)
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8)
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | muxer.nextContinuity(pid)
+	packet[4] = 0 //pointer_field
+	n := copy(packet[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		packet[i] = 0xFF
+	}
+	return packet
+}
+
+func (muxer *tsMuxer) nextContinuity(pid uint16) byte {
+	cc := muxer.continuity[pid]
+	muxer.continuity[pid] = (cc + 1) & 0x0F
+	return cc
+}
+
+// 一帧视频,前面加访问单元分隔符,关键帧带参数集
+func (muxer *tsMuxer) video(sample *Sample, pts uint64, pcr uint64) []byte {
+	aud := []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}
+	if muxer.hevc {
+		aud = []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+	}
+	pes := tsPesHeader(0xE0, pts, 0)
+	pes = append(pes, aud...)
+	pes = append(pes, sample.AnnexB(true)...)
+	return muxer.packetize(tsVideoPid, pes, &pcr, sample.KeyFrame)
+}
+
+// 一个opus包,前面加opus_control_header
+func (muxer *tsMuxer) opus(data []byte, pts uint64) []byte {
+	payload := []byte{0x7F, 0xE0}
+	size := len(data)
+	for ; size >= 255; size -= 255 {
+		payload = append(payload, 0xFF)
+	}
+	payload = append(payload, byte(size))
+	payload = append(payload, data...)
+	pes := tsPesHeader(0xBD, pts, len(payload))
+	return muxer.packetize(tsAudioPid, append(pes, payload...), nil, false)
+}
+
+// 只带pts的pes头,payloadSize为0时长度不限(只用于视频)
+func tsPesHeader(streamId byte, pts uint64, payloadSize int) []byte {
+	length := 0
+	if payloadSize > 0 {
+		length = 3 + 5 + payloadSize
+		if length > 0xFFFF {
+			length = 0
+		}
+	}
+	pts &= 0x1FFFFFFFF
+	return []byte{
+		0x00, 0x00, 0x01, streamId, byte(length >> 8), byte(length),
+		0x84, 0x80, 0x05, //data_alignment, PTS_DTS_flags=10
+		0x21 | byte(pts>>29)&0x0E, byte(pts >> 22), byte(pts>>14) | 0x01, byte(pts >> 7), byte(pts<<1) | 0x01,
+	}
+}
+
+// 切成188字节的ts包,第一个包带pcr和随机访问标志,最后一个包用自适应字段填充
+func (muxer *tsMuxer) packetize(pid uint16, pes []byte, pcr *uint64, randomAccess bool) []byte {
+	buf := make([]byte, 0, (len(pes)/184+2)*tsPacketSize)
+	first := true
+	for len(pes) > 0 {
+		var adaptation []byte
+		if first && (pcr != nil || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = []byte{flags}
+			if pcr != nil {
+				adaptation[0] |= 0x10
+				base := *pcr & 0x1FFFFFFFF
+				adaptation = append(adaptation, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7E, 0x00)
+			}
+		}
+		capacity := 184
+		if adaptation != nil {
+			capacity = 183 - len(adaptation)
+		}
+		if stuffing := capacity - len(pes); stuffing > 0 {
+			if adaptation == nil {
+				adaptation = []byte{}
+				if stuffing > 1 {
+					adaptation = append(adaptation, 0x00)
+					stuffing -= 2
+				} else {
+					stuffing = 0
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptation = append(adaptation, 0xFF)
+			}
+			capacity = len(pes)
+		}
+		header := []byte{0x47, byte(pid>>8) & 0x1F, byte(pid), muxer.nextContinuity(pid)}
+		if first {
+			header[1] |= 0x40
+		}
+		if adaptation != nil {
+			header[3] |= 0x30
+			header = append(header, byte(len(adaptation)))
+			header = append(header, adaptation...)
+		} else {
+			header[3] |= 0x10
+		}
+		buf = append(buf, header...)
+		buf = append(buf, pes[:capacity]...)
+		pes = pes[capacity:]
+		first = false
+	}
+	return buf
+}
+
+// MPEG-2的crc32,多项式0x04C11DB7,不反转
+func crc32Mpeg2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// http输出的一个观看端
+type tsSink struct {
+	w            http.ResponseWriter
+	controller   *http.ResponseController
+	webrtcServer *WebrtcServer
+	audio        bool
+	muxer        *tsMuxer
+	started      bool
+	baseTime     int64  //pts为0对应的时间戳,微秒
+	lastPts      uint64 //最后一帧视频的pts(不含延时),重新开始时接着算
+	closed       bool
+	done         chan struct{}
+}
+
+func (sink *tsSink) WriteSample(sample *Sample) {
+	if sink.closed {
+		return
+	}
+	if sample.Audio {
+		if sink.audio && sink.started && sample.Timestamp >= sink.baseTime {
+			sink.write(sink.muxer.opus(sample.Data, sink.pts(sample.Timestamp)+tsPtsDelay))
+		}
+		return
+	}
+	if !sample.KeyFrame && !sink.started {
+		return
+	}
+	var buf []byte
+	if sample.KeyFrame {
+		if !sink.started {
+			resume := int64(0)
+			if sink.muxer != nil {
+				resume = int64(sink.lastPts)*100/9 + 1000
+			} else {
+				sink.muxer = newTsMuxer(strings.EqualFold(sample.MimeType, webrtc.MimeTypeH265), sink.audio, sink.webrtcServer.OpusHead())
+			}
+			sink.baseTime = sample.Timestamp - resume
+			sink.started = true
+		}
+		buf = sink.muxer.psi()
+	}
+	pts := sink.pts(sample.Timestamp)
+	sink.lastPts = pts
+	buf = append(buf, sink.muxer.video(sample, pts+tsPtsDelay, pts)...)
+	sink.write(buf)
+}
+
+// 设备断开,下一个关键帧重新开始,时间戳接着之前的继续
+func (sink *tsSink) StreamEnd() {
+	sink.started = false
+}
+
+func (sink *tsSink) pts(timestamp int64) uint64 {
+	return uint64(timestamp-sink.baseTime) * 9 / 100
+}
+
+func (sink *tsSink) write(data []byte) {
+	sink.controller.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := sink.w.Write(data)
+	if err == nil {
+		err = sink.controller.Flush()
+	}
+	if err != nil {
+		sink.closed = true
+		close(sink.done)
+	}
+}
+
+/*
+GET /stream.ts 或 /api/devices/{id}/stream.ts
+chunked输出的MPEG-TS,可以直接 ffplay http://host:8081/stream.ts ,鉴权和WHEP一致,
+密码可以用Authorization: Bearer或者query里的token/timestamp,audio=1时带上opus音轨
+*/
+func (wsServer *WsServer) handleTs(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkBearerAuth(w, r) {
+		return
+	}
+	mimeType := wsServer.webrtcServer.MimeType()
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH264) && !strings.EqualFold(mimeType, webrtc.MimeTypeH265) {
+		http.Error(w, "ts unsupported codec "+mimeType, http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	sink := &tsSink{
+		w:            w,
+		controller:   http.NewResponseController(w),
+		webrtcServer: wsServer.webrtcServer,
+		audio:        r.URL.Query().Get("audio") == "1",
+		done:         make(chan struct{}),
+	}
+	if err := sink.controller.Flush(); err != nil {
+		fmt.Printf("ts flush err:%+v\r\n", err)
+		return
+	}
+	wsServer.webrtcServer.AddSink(sink)
+	//从关键帧开始播放
+	wsServer.webrtcServer.RequestKeyFrame()
+	select {
+	case <-r.Context().Done():
+	case <-sink.done:
+	}
+	wsServer.webrtcServer.RemoveSink(sink)
+}
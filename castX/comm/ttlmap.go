@@ -20,12 +20,26 @@ func (ttlmap *ttlMap) Add(token string, value interface{}) {
 	ttlmap.keyTime[token] = time.Now().UnixMilli()
 }
 func (ttlmap *ttlMap) IsExists(token string) bool {
+	ttlmap.mu.RLock()
+	defer ttlmap.mu.RUnlock()
 	if _, exists := ttlmap.tokenInfo[token]; exists {
 		return true
 	}
 	return false
 }
 
+// 不存在时添加并返回true,已存在返回false,检查和添加在同一把锁里
+func (ttlmap *ttlMap) AddIfNotExists(token string, value interface{}) bool {
+	ttlmap.mu.Lock()
+	defer ttlmap.mu.Unlock()
+	if _, exists := ttlmap.tokenInfo[token]; exists {
+		return false
+	}
+	ttlmap.tokenInfo[token] = value
+	ttlmap.keyTime[token] = time.Now().UnixMilli()
+	return true
+}
+
 func NewTTLMap(ttl int64) *ttlMap {
 	m := &ttlMap{
 		tokenInfo: make(map[string]interface{}),
@@ -2,140 +2,344 @@ package comm
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"runtime"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/wlynxg/anet"
 )
 
 type WebrtcServer struct {
-	lastVideoTimestamp          int64
+	lastVideoTimestamp          int64 //sourceMu保护
 	lastAudioTimestamp          int64
+	sourceOwner                 string //独占的推流来源(whip、relay),为空时是本地来源
+	lastLocalSample             time.Time
+	sourceMu                    sync.Mutex
 	webRtcConnectionStateChange func(int)
-	outboundVideoTrack          *webrtc.TrackLocalStaticSample
-	outboundAudioTrack          *webrtc.TrackLocalStaticSample
-	peerConnectionCount         int64
+	peerConnectionCount         int64 //已连接的观看端数量,peerMu保护
+	peers                       map[string]*viewerPeer
+	peerMu                      sync.Mutex
+	mimeType                    string
+	videoAssembler              *videoAssembler
+	gop                         gopCache
+	videoPacketizer             rtp.Packetizer
+	videoMu                     sync.Mutex //保护videoAssembler、videoPacketizer和gop
+	audioPacketizer             rtp.Packetizer
+	audioMu                     sync.Mutex //保护audioPacketizer和opusHead
+	abr                         abrController
+	abrRunning                  bool
+	estimate                    int //观看端带宽估计
+	notifiedEstimate            int
+	bitRateCall                 func(int)
+	estimateCall                func(int, int)
+	abrMu                       sync.Mutex
+	newEstimator                cc.BandwidthEstimator //创建连接时由拦截器回调设置,newPeerMu保护
+	newRepair                   *repairInterceptor
+	newPeerMu                   sync.Mutex
+	opusHead                    *OpusHead
+	sinks                       map[SampleSink]*sinkQueue
+	sinkMu                      sync.RWMutex
+	config                      *Config
+	iceTransport                *IceTransport
+	api                         *webrtc.API
+	apiMu                       sync.Mutex
+	keyFrameRequestCall         func() //请求编码端输出关键帧
+	lastKeyFrameRequest         time.Time
+	keyFrameMu                  sync.Mutex
 }
 
 func (webrtcServer *WebrtcServer) SetWebRtcConnectionStateChange(_webRtcConnectionStateChange func(int)) {
 	webrtcServer.webRtcConnectionStateChange = _webRtcConnectionStateChange
 }
 
-func (webrtcServer *WebrtcServer) SendVideo(nal []byte, timestamp int64) {
-	var duration time.Duration = 0
-	if webrtcServer.lastVideoTimestamp == 0 {
-		duration = time.Second / 40
-	} else {
-		duration = time.Duration(timestamp-webrtcServer.lastVideoTimestamp) * time.Microsecond
+// 设置配置,用于ice服务器等连接参数
+func (webrtcServer *WebrtcServer) SetConfig(config *Config) {
+	webrtcServer.config = config
+}
+
+func (webrtcServer *WebrtcServer) webrtcConfiguration() webrtc.Configuration {
+	if webrtcServer.config == nil {
+		return webrtc.Configuration{}
 	}
-	webrtcServer.lastVideoTimestamp = timestamp
-	webrtcServer.SendWebrtc(nal, timestamp, duration, false)
+	return webrtcServer.config.WebrtcConfiguration()
 }
-func (webrtcServer *WebrtcServer) SendAudio(nal []byte, timestamp int64) {
-	var duration time.Duration = 0
-	if webrtcServer.lastAudioTimestamp == 0 {
-		duration = time.Second / 40
-	} else {
-		duration = time.Duration(timestamp-webrtcServer.lastAudioTimestamp) * time.Microsecond
+
+// 共用的ice端口和SettingEngine,第一次创建连接时按配置初始化
+func (webrtcServer *WebrtcServer) IceTransport() (*IceTransport, error) {
+	webrtcServer.apiMu.Lock()
+	defer webrtcServer.apiMu.Unlock()
+	if webrtcServer.iceTransport == nil {
+		config := webrtcServer.config
+		if config == nil {
+			config = &Config{}
+		}
+		iceTransport, err := NewIceTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		webrtcServer.iceTransport = iceTransport
+	}
+	return webrtcServer.iceTransport, nil
+}
+
+func (webrtcServer *WebrtcServer) getApi() (*webrtc.API, error) {
+	iceTransport, err := webrtcServer.IceTransport()
+	if err != nil {
+		return nil, err
+	}
+	webrtcServer.apiMu.Lock()
+	defer webrtcServer.apiMu.Unlock()
+	if webrtcServer.api == nil {
+		if webrtcServer.api, err = iceTransport.newAPI(nil, webrtcServer.registerInterceptors); err != nil {
+			return nil, err
+		}
+	}
+	return webrtcServer.api, nil
+}
+
+// 关闭共用的ice端口,之后再创建连接会重新监听
+func (webrtcServer *WebrtcServer) CloseIce() {
+	webrtcServer.apiMu.Lock()
+	defer webrtcServer.apiMu.Unlock()
+	if webrtcServer.iceTransport != nil {
+		webrtcServer.iceTransport.Close()
+		webrtcServer.iceTransport = nil
+		webrtcServer.api = nil
 	}
-	webrtcServer.lastAudioTimestamp = timestamp
-	webrtcServer.SendWebrtc(nal, timestamp, duration, true)
 }
 
+// 本地来源的视频,WHIP或中继独占时丢弃
+func (webrtcServer *WebrtcServer) SendVideo(nal []byte, timestamp int64) {
+	webrtcServer.sendVideoFrom("", nal, timestamp)
+}
+func (webrtcServer *WebrtcServer) SendAudio(nal []byte, timestamp int64) {
+	webrtcServer.sendAudioFrom("", nal, timestamp)
+}
+
+// 本地来源自带时长的数据,WHIP或中继独占时丢弃
 func (webrtcServer *WebrtcServer) SendWebrtc(data []byte, timestamp int64, duration time.Duration, audio bool) error {
-	var err error
+	if !webrtcServer.localSource() {
+		return nil
+	}
+	return webrtcServer.sendWebrtc(data, timestamp, duration, audio)
+}
+
+func (webrtcServer *WebrtcServer) sendWebrtc(data []byte, timestamp int64, duration time.Duration, audio bool) error {
 	if audio {
-		err = webrtcServer.outboundAudioTrack.WriteSample(media.Sample{
-			Data:      data,
-			Duration:  duration,
-			Timestamp: time.UnixMicro(timestamp),
-		})
-	} else {
-		err = webrtcServer.outboundVideoTrack.WriteSample(media.Sample{
-			Data:      data,
-			Duration:  duration,
-			Timestamp: time.UnixMicro(timestamp),
-		})
-	}
-	return err
-}
-
-// HTTP Handler that accepts an Offer and returns an Answer
-// adds outboundVideoTrack to PeerConnection
-func (webrtcServer *WebrtcServer) getSdp(r io.Reader) (*webrtc.SessionDescription, error) {
+		if isOpusConfig(data) {
+			webrtcServer.audioMu.Lock()
+			webrtcServer.opusHead = parseOpusConfig(data)
+			webrtcServer.audioMu.Unlock()
+			return nil
+		}
+		webrtcServer.audioMu.Lock()
+		packets := webrtcServer.audioPacketizer.Packetize(data, 0)
+		for _, packet := range packets {
+			packet.Timestamp = uint32(timestamp * 48 / 1000)
+		}
+		webrtcServer.writePeers(&rtpFrame{audio: true, packets: packets})
+		webrtcServer.audioMu.Unlock()
+		webrtcServer.dispatchAudio(data, timestamp, duration)
+		return nil
+	}
+	//整理成完整帧后只打包一次,放进每个观看端的队列,新加入的先补发GOP缓存
+	webrtcServer.videoMu.Lock()
+	sample := webrtcServer.videoAssembler.push(data, timestamp, duration)
+	if sample == nil {
+		webrtcServer.videoMu.Unlock()
+		return nil
+	}
+	if frame := webrtcServer.packetizeVideo(sample); frame != nil {
+		webrtcServer.gop.push(frame)
+		webrtcServer.writePeers(frame)
+	}
+	webrtcServer.videoMu.Unlock()
+	webrtcServer.dispatchSample(sample)
+	return nil
+}
+
+// 添加样本接收端(录制等),接收端在独立队列里处理,不影响webrtc推流
+func (webrtcServer *WebrtcServer) AddSink(sink SampleSink) {
+	webrtcServer.addSink(sink, 512)
+}
+
+// size为队列长度,实时输出用较短的队列,积压时尽快丢到下一个关键帧
+func (webrtcServer *WebrtcServer) addSink(sink SampleSink, size int) {
+	webrtcServer.sinkMu.Lock()
+	defer webrtcServer.sinkMu.Unlock()
+	if _, ok := webrtcServer.sinks[sink]; !ok {
+		webrtcServer.sinks[sink] = newSinkQueue(sink, size)
+	}
+}
+
+// 移除接收端,会等待队列里剩余的数据处理完
+func (webrtcServer *WebrtcServer) RemoveSink(sink SampleSink) {
+	webrtcServer.sinkMu.Lock()
+	queue, ok := webrtcServer.sinks[sink]
+	delete(webrtcServer.sinks, sink)
+	webrtcServer.sinkMu.Unlock()
+	if ok {
+		queue.close()
+	}
+}
+
+// 设备断开,通知接收端结束当前文件/流
+func (webrtcServer *WebrtcServer) StreamEnd() {
+	webrtcServer.videoMu.Lock()
+	webrtcServer.videoAssembler.pending = nil
+	webrtcServer.gop.reset()
+	webrtcServer.videoMu.Unlock()
+	webrtcServer.sinkMu.Lock()
+	defer webrtcServer.sinkMu.Unlock()
+	for _, queue := range webrtcServer.sinks {
+		queue.push(nil)
+	}
+}
+
+// 关闭所有接收端
+func (webrtcServer *WebrtcServer) CloseSinks() {
+	webrtcServer.sinkMu.Lock()
+	sinks := webrtcServer.sinks
+	webrtcServer.sinks = make(map[SampleSink]*sinkQueue)
+	webrtcServer.sinkMu.Unlock()
+	for _, queue := range sinks {
+		queue.close()
+	}
+}
+
+func (webrtcServer *WebrtcServer) MimeType() string {
+	return webrtcServer.mimeType
+}
+
+// 最近一次收到的OpusHead,没有时为nil
+func (webrtcServer *WebrtcServer) OpusHead() *OpusHead {
+	webrtcServer.audioMu.Lock()
+	defer webrtcServer.audioMu.Unlock()
+	return webrtcServer.opusHead
+}
+
+// 音频包分发给所有接收端
+func (webrtcServer *WebrtcServer) dispatchAudio(data []byte, timestamp int64, duration time.Duration) {
+	webrtcServer.sinkMu.RLock()
+	empty := len(webrtcServer.sinks) == 0
+	webrtcServer.sinkMu.RUnlock()
+	if empty {
+		return
+	}
+	webrtcServer.dispatchSample(&Sample{
+		MimeType:  webrtc.MimeTypeOpus,
+		Audio:     true,
+		Timestamp: timestamp,
+		Duration:  duration,
+		Data:      append([]byte(nil), data...),
+	})
+}
+
+// 完整帧分发给所有接收端
+func (webrtcServer *WebrtcServer) dispatchSample(sample *Sample) {
+	webrtcServer.sinkMu.RLock()
+	defer webrtcServer.sinkMu.RUnlock()
+	for _, queue := range webrtcServer.sinks {
+		queue.push(sample)
+	}
+}
+
+/*
+根据offer创建推流连接,session为观看端会话,同一会话重新协商时关闭旧连接
+onCandidate为空时等候选地址收集完再返回,answer里带全部候选地址;
+不为空时立即返回answer,候选地址通过onCandidate逐个回调,最后回调nil表示收集结束
+*/
+func (webrtcServer *WebrtcServer) newPeer(session string, offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) (*webrtc.SessionDescription, error) {
 	if runtime.GOOS == "android" {
 		anet.SetAndroidVersion(14)
 	}
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	api, err := webrtcServer.getApi()
 	if err != nil {
 		return nil, err
 	}
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		if connectionState == webrtc.ICEConnectionStateDisconnected {
-			atomic.AddInt64(&webrtcServer.peerConnectionCount, -1)
-			if webrtcServer.webRtcConnectionStateChange != nil {
-				webrtcServer.webRtcConnectionStateChange(int(webrtcServer.peerConnectionCount))
-			}
-		} else if connectionState == webrtc.ICEConnectionStateConnected {
-			atomic.AddInt64(&webrtcServer.peerConnectionCount, 1)
-			if webrtcServer.webRtcConnectionStateChange != nil {
-				webrtcServer.webRtcConnectionStateChange(int(webrtcServer.peerConnectionCount))
-			}
-		}
+	webrtcServer.newPeerMu.Lock()
+	webrtcServer.newEstimator = nil
+	webrtcServer.newRepair = nil
+	peerConnection, err := api.NewPeerConnection(webrtcServer.webrtcConfiguration())
+	estimator := webrtcServer.newEstimator
+	repair := webrtcServer.newRepair
+	webrtcServer.newPeerMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	peer := &viewerPeer{session: session, peerConnection: peerConnection, estimator: estimator}
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		webrtcServer.peerStateChange(peer, state)
 	})
-	//添加视频
-	if _, err = peerConnection.AddTrack(webrtcServer.outboundVideoTrack); err != nil {
+	webrtcServer.addPeer(peer)
+	//每个观看端单独的轨道,rtp包由写协程写入,可以先补发GOP缓存
+	peer.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType: webrtcServer.mimeType,
+	}, "screens", "screens")
+	if err != nil {
+		webrtcServer.closePeer(peer)
 		return nil, err
 	}
+	videoSender, err := peerConnection.AddTrack(peer.videoTrack)
+	if err != nil {
+		webrtcServer.closePeer(peer)
+		return nil, err
+	}
+	go webrtcServer.readRTCP(videoSender)
 	//添加音频
-	if _, err = peerConnection.AddTrack(webrtcServer.outboundAudioTrack); err != nil {
+	peer.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: 48000, // Opus标准采样率
+		Channels:  2,     // 立体声
+	}, "audio", "screens")
+	if err != nil {
+		webrtcServer.closePeer(peer)
 		return nil, err
 	}
-
-	var offer webrtc.SessionDescription
-	if err = json.NewDecoder(r).Decode(&offer); err != nil {
+	if _, err = peerConnection.AddTrack(peer.audioTrack); err != nil {
+		webrtcServer.closePeer(peer)
 		return nil, err
 	}
 	if err = peerConnection.SetRemoteDescription(offer); err != nil {
+		webrtcServer.closePeer(peer)
 		return nil, err
 	}
+	if onCandidate != nil {
+		peerConnection.OnICECandidate(onCandidate)
+	}
 	gatherCompletePromise := webrtc.GatheringCompletePromise(peerConnection)
 
+	repairParams := webrtcServer.setupRepair(repair, videoSender)
 	answer, err := peerConnection.CreateAnswer(nil)
+	if err == nil {
+		err = peerConnection.SetLocalDescription(answer)
+	}
 	if err != nil {
-		return nil, err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+		webrtcServer.closePeer(peer)
 		return nil, err
 	}
-	<-gatherCompletePromise
-	return peerConnection.LocalDescription(), nil
+	if onCandidate == nil {
+		<-gatherCompletePromise
+	}
+	answer = *peerConnection.LocalDescription()
+	answer.SDP = addSSRCGroups(answer.SDP, repairParams)
+	return &answer, nil
 }
 
 func NewWebRtc(mimeType string) (*WebrtcServer, error) {
-	var err error
-	webrtcServer := &WebrtcServer{}
-	//视频轨道
-	webrtcServer.outboundVideoTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
-		MimeType: mimeType,
-	}, "screens", "screens")
-	if err != nil {
-		return nil, err
-	}
-	//音频轨道
-	webrtcServer.outboundAudioTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
-		MimeType:  "audio/opus",
-		ClockRate: 48000, // Opus标准采样率
-		Channels:  2,     // 立体声
-	}, "audio", "screens")
-	if err != nil {
-		return nil, err
+	webrtcServer := &WebrtcServer{mimeType: mimeType}
+	webrtcServer.videoAssembler = newVideoAssembler(mimeType)
+	webrtcServer.sinks = make(map[SampleSink]*sinkQueue)
+	webrtcServer.peers = make(map[string]*viewerPeer)
+	//ssrc和payload type由各个连接的轨道改写
+	if payloader := newPayloader(mimeType); payloader != nil {
+		webrtcServer.videoPacketizer = rtp.NewPacketizer(webrtcMtu, 0, 0, payloader, rtp.NewRandomSequencer(), 90000)
 	}
+	webrtcServer.audioPacketizer = rtp.NewPacketizer(webrtcMtu, 0, 0, newPayloader(webrtc.MimeTypeOpus), rtp.NewRandomSequencer(), 48000)
 	return webrtcServer, nil
 }
 
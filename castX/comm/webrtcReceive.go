@@ -1,38 +1,99 @@
 package comm
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
 	"github.com/wlynxg/anet"
 )
 
 type WebrtcReceive struct {
-	receiveCall func(int, []byte, int64)
+	receiveCall    func(int, []byte, int64)
+	token          string //WHEP的Bearer token,即对端的连接密码
+	peerConnection *webrtc.PeerConnection
+	location       string //WHEP会话地址,关闭时DELETE
+	iceServers     []IceServer
+	iceTransport   *IceTransport //为空时使用默认设置
+	latency        time.Duration //抖动缓冲等待缺包的时间
+	frameEndCall   func()        //一个完整视频帧回调完成
+	closeCall      func()        //连接失败或者关闭
+	videoMu        sync.Mutex
+	videoTrack     *webrtc.TrackRemote
 }
 
 func (webrtcReceive *WebrtcReceive) SetReceiveCall(compare func(int, []byte, int64)) {
 	webrtcReceive.receiveCall = compare
 }
 
+// 视频帧的nalu都回调完后调用,用于按帧转发
+func (webrtcReceive *WebrtcReceive) SetFrameEndCall(frameEndCall func()) {
+	webrtcReceive.frameEndCall = frameEndCall
+}
+
+// 连接失败或者关闭时调用,用于重连
+func (webrtcReceive *WebrtcReceive) SetCloseCall(closeCall func()) {
+	webrtcReceive.closeCall = closeCall
+}
+
+// 向发送端请求关键帧
+func (webrtcReceive *WebrtcReceive) RequestKeyFrame() {
+	webrtcReceive.videoMu.Lock()
+	peerConnection, track := webrtcReceive.peerConnection, webrtcReceive.videoTrack
+	webrtcReceive.videoMu.Unlock()
+	if peerConnection != nil && track != nil {
+		peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+	}
+}
+
+func (webrtcReceive *WebrtcReceive) SetIceServers(iceServers []IceServer) {
+	webrtcReceive.iceServers = iceServers
+}
+
+// 和WebrtcServer共用ice端口等网络设置
+func (webrtcReceive *WebrtcReceive) SetIceTransport(iceTransport *IceTransport) {
+	webrtcReceive.iceTransport = iceTransport
+}
+
+// 抖动缓冲等待乱序/重传包的毫秒数,越大越抗丢包但延迟越高
+func (webrtcReceive *WebrtcReceive) SetLatency(ms int) {
+	webrtcReceive.latency = time.Duration(ms) * time.Millisecond
+}
+
+func (webrtcReceive *WebrtcReceive) SetToken(token string) {
+	webrtcReceive.token = token
+}
+
+// 通过WHEP地址拉流,例如 http://127.0.0.1:8081/whep
 func (webrtcReceive *WebrtcReceive) StartWebRtcReceive(url string, writeFile bool) error {
 	if runtime.GOOS == "android" {
 		anet.SetAndroidVersion(14)
 	}
-	depacketizer := NewH264Depacketizer(webrtcReceive, writeFile)
 	// WebRTC配置
-	config := webrtc.Configuration{}
+	config := webrtc.Configuration{ICEServers: toWebrtcIceServers(webrtcReceive.iceServers)}
+	//丢包时nack请求重传,服务端协商了rtx时由pion还原
+	mediaEngine, err := newReceiveMediaEngine()
+	if err != nil {
+		return err
+	}
+	api, err := webrtcReceive.iceTransport.newAPI(mediaEngine, registerReceiveInterceptors)
+	if err != nil {
+		return err
+	}
 	// 创建PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(config)
 	if err != nil {
 		fmt.Printf("StartWebRtcReceive err:%+v\n", err)
 		return err
@@ -50,71 +111,220 @@ func (webrtcReceive *WebrtcReceive) StartWebRtcReceive(url string, writeFile boo
 		fmt.Printf("接收到 %s 轨道\n", track.Kind())
 		// 创建内存缓冲区
 		fmt.Printf("开始接收轨道: %s\n", track.Codec().MimeType)
-		if track.Codec().MimeType == "video/H264" {
-			go func() {
-				for {
-					rtpPacket, _, err := track.ReadRTP()
-					if err != nil {
-						break
-					}
-					//comm.ProcessNalUnit(rtpPacket.Payload)
-					depacketizer.ProcessRTP(rtpPacket)
+		var depacketizer *H264Depacketizer
+		switch mimeType := track.Codec().MimeType; {
+		case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+			depacketizer = NewH264Depacketizer(webrtcReceive, writeFile)
+		case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+			depacketizer = NewH265Depacketizer(webrtcReceive, writeFile)
+		case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+			go webrtcReceive.readOpus(track, writeFile)
+			return
+		default:
+			return
+		}
+		webrtcReceive.videoMu.Lock()
+		webrtcReceive.videoTrack = track
+		webrtcReceive.videoMu.Unlock()
+		//丢包后请求发送端出关键帧
+		depacketizer.keyFrameCall = func() {
+			peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+		}
+		depacketizer.frameEndCall = webrtcReceive.frameEndCall
+		go func() {
+			for {
+				rtpPacket, _, err := track.ReadRTP()
+				if err != nil {
+					break
 				}
-			}()
+				depacketizer.ProcessRTP(rtpPacket)
+			}
+		}()
+	})
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if (state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed) && webrtcReceive.closeCall != nil {
+			webrtcReceive.closeCall()
 		}
 	})
 	gatherCompletePromise := webrtc.GatheringCompletePromise(peerConnection)
 	// 创建Offer
 	offer, err := peerConnection.CreateOffer(nil)
 	if err != nil {
+		peerConnection.Close()
 		fmt.Printf("StartWebRtcReceive err:%+v\n", err)
 		return err
 	}
-	fmt.Printf("StartWebRtcReceive4\r\n")
 	// 设置本地描述
 	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		peerConnection.Close()
 		return err
 	}
 	<-gatherCompletePromise
 
-	// 发送Offer到信令服务
-	answer := getOffer(*peerConnection.LocalDescription(), url)
+	// 发送Offer到WHEP服务
+	answer, location, err := webrtcReceive.whepOffer(*peerConnection.LocalDescription(), url)
+	if err != nil {
+		peerConnection.Close()
+		fmt.Printf("StartWebRtcReceive err:%+v\n", err)
+		return err
+	}
 
 	// 设置远程描述
 	if err = peerConnection.SetRemoteDescription(answer); err != nil {
+		peerConnection.Close()
 		fmt.Printf("StartWebRtcReceive err:%+v\n", err)
 		return err
 	}
+	webrtcReceive.videoMu.Lock()
+	webrtcReceive.peerConnection = peerConnection
+	webrtcReceive.videoMu.Unlock()
+	webrtcReceive.location = location
 	return nil
 }
 
-// 信令交互
-func getOffer(offer webrtc.SessionDescription, url string) webrtc.SessionDescription {
-	offerJSON, _ := json.Marshal(offer)
-	resp, _ := http.Post(url, "application/json", bytes.NewReader(offerJSON))
-	var data = make(map[string]interface{})
-	json.NewDecoder(resp.Body).Decode(&data)
-	answerStr, _ := json.Marshal(data["sdp"])
-	fmt.Printf("answerStr:%s\r\n", answerStr)
+// 结束拉流,通知WHEP服务删除会话
+func (webrtcReceive *WebrtcReceive) Close() error {
+	if webrtcReceive.peerConnection == nil {
+		return nil
+	}
+	err := webrtcReceive.peerConnection.Close()
+	webrtcReceive.videoMu.Lock()
+	webrtcReceive.peerConnection = nil
+	webrtcReceive.videoTrack = nil
+	webrtcReceive.videoMu.Unlock()
+	if len(webrtcReceive.location) > 0 {
+		req, _ := http.NewRequest(http.MethodDelete, webrtcReceive.location, nil)
+		webrtcReceive.setAuth(req)
+		if resp, e := http.DefaultClient.Do(req); e == nil {
+			resp.Body.Close()
+		}
+		webrtcReceive.location = ""
+	}
+	return err
+}
+
+func (webrtcReceive *WebrtcReceive) setAuth(req *http.Request) {
+	if len(webrtcReceive.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+webrtcReceive.token)
+	}
+}
+
+// WHEP信令交互,返回answer和会话地址
+func (webrtcReceive *WebrtcReceive) whepOffer(offer webrtc.SessionDescription, whepUrl string) (webrtc.SessionDescription, string, error) {
 	var answer webrtc.SessionDescription
-	json.NewDecoder(bytes.NewBuffer([]byte(answerStr))).Decode(&answer)
-	return answer
+	req, err := http.NewRequest(http.MethodPost, whepUrl, strings.NewReader(offer.SDP))
+	if err != nil {
+		return answer, "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	webrtcReceive.setAuth(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return answer, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return answer, "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return answer, "", fmt.Errorf("whep %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	location := resp.Header.Get("Location")
+	if len(location) > 0 {
+		if base, err := url.Parse(whepUrl); err == nil {
+			if ref, err := base.Parse(location); err == nil {
+				location = ref.String()
+			}
+		}
+	}
+	answer = webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)}
+	return answer, location, nil
+}
+
+// receiveCall的cmd,收到ReceiveCmdVps说明视频是h265
+const (
+	ReceiveCmdVideo = 1 //一个视频nalu,时间戳为90k时钟
+	ReceiveCmdSps   = 2
+	ReceiveCmdPps   = 3
+	ReceiveCmdAudio = 4 //一个opus包,时间戳为48k时钟
+	ReceiveCmdVps   = 5
+)
+
+// 默认编码之外加上h265,pion v3默认不协商h265
+func newReceiveMediaEngine() (*webrtc.MediaEngine, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000},
+		PayloadType:        49,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	return mediaEngine, nil
+}
+
+// opus一个rtp包就是一帧,直接回调,writeFile时另存为output.ogg
+func (webrtcReceive *WebrtcReceive) readOpus(track *webrtc.TrackRemote, writeFile bool) {
+	var oggFile *oggwriter.OggWriter
+	if writeFile {
+		channels := track.Codec().Channels
+		if channels == 0 {
+			channels = 2
+		}
+		if f, err := oggwriter.New("output.ogg", 48000, channels); err == nil {
+			oggFile = f
+			defer oggFile.Close()
+		}
+	}
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if len(packet.Payload) == 0 {
+			continue
+		}
+		if webrtcReceive.receiveCall != nil {
+			webrtcReceive.receiveCall(ReceiveCmdAudio, packet.Payload, int64(packet.Timestamp))
+		}
+		if oggFile != nil {
+			oggFile.WriteRTP(packet)
+		}
+	}
 }
 
+// h264和h265共用抖动缓冲和组帧,hevc时按RFC 7798拆包
 type H264Depacketizer struct {
 	file           *os.File
+	hevc           bool
+	vps            []byte
 	sps            []byte
 	pps            []byte
 	fragmentBuffer []byte
-	lastTimestamp  uint32
 	mu             sync.Mutex
 	writeFile      bool
 	webrtcReceive  *WebrtcReceive
+	jitter         *jitterBuffer
+	jitterTimer    *time.Timer //缺包等待超时后继续输出
+	frame          [][]byte    //当前访问单元已还原的nalu
+	frameTimestamp uint32
+	hasFrame       bool
+	frameBroken    bool //当前访问单元有缺包
+	lostPending    bool //丢包后下一个访问单元可能缺头部
+	waitKeyFrame   bool //丢包后直到关键帧才继续输出
+	lastKeyRequest time.Time
+	keyFrameCall   func() //请求关键帧(PLI)
+	frameEndCall   func() //一个完整访问单元输出完成
 }
 
 func NewH264Depacketizer(webrtcReceive *WebrtcReceive, _writeFile bool) *H264Depacketizer {
 	h264Decode := &H264Depacketizer{
-		writeFile: _writeFile,
+		writeFile:    _writeFile,
+		jitter:       newJitterBuffer(webrtcReceive.latency),
+		waitKeyFrame: true,
 	}
 	if _writeFile {
 		f, _ := os.Create("output.264")
@@ -124,58 +334,195 @@ func NewH264Depacketizer(webrtcReceive *WebrtcReceive, _writeFile bool) *H264Dep
 	return h264Decode
 }
 
+func NewH265Depacketizer(webrtcReceive *WebrtcReceive, _writeFile bool) *H264Depacketizer {
+	h265Decode := &H264Depacketizer{
+		hevc:         true,
+		writeFile:    _writeFile,
+		jitter:       newJitterBuffer(webrtcReceive.latency),
+		waitKeyFrame: true,
+	}
+	if _writeFile {
+		f, _ := os.Create("output.265")
+		h265Decode.file = f
+	}
+	h265Decode.webrtcReceive = webrtcReceive
+	return h265Decode
+}
+
 func (d *H264Depacketizer) ProcessRTP(pkt *rtp.Packet) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	payload := pkt.Payload
-	if len(payload) < 1 {
+	now := time.Now()
+	d.jitter.push(pkt, now)
+	d.drain(now)
+}
+
+// 输出抖动缓冲里能按序输出的包,还有缺包时定时到期再处理,不依赖下一个包到达,调用时持有mu
+func (d *H264Depacketizer) drain(now time.Time) {
+	for {
+		packet, lost := d.jitter.pop(now)
+		if packet == nil {
+			break
+		}
+		if lost {
+			d.frameBroken = true
+			d.lostPending = true
+		}
+		d.depacketize(packet)
+	}
+	deadline, ok := d.jitter.deadline()
+	if !ok {
 		return
 	}
+	if d.jitterTimer == nil {
+		d.jitterTimer = time.AfterFunc(deadline.Sub(now), d.jitterTimeout)
+	} else {
+		d.jitterTimer.Reset(deadline.Sub(now))
+	}
+}
+
+func (d *H264Depacketizer) jitterTimeout() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.drain(time.Now())
+}
+
+// 按序处理一个rtp包,时间戳变化或者marker位表示访问单元结束
+func (d *H264Depacketizer) depacketize(pkt *rtp.Packet) {
+	if d.hasFrame && pkt.Timestamp != d.frameTimestamp {
+		d.finishFrame()
+	}
+	if !d.hasFrame {
+		d.hasFrame = true
+		d.frameTimestamp = pkt.Timestamp
+		d.frameBroken = d.lostPending
+	}
+	d.lostPending = false
+
+	payload := pkt.Payload
+	if d.hevc && len(payload) > 2 {
+		switch naluType := (payload[0] >> 1) & 0x3F; naluType {
+		case 48: // AP聚合包
+			d.processAggregation(payload, 2)
+		case 49: // FU分片
+			d.processFU(payload)
+		case 50: // PACI不处理
+		default:
+			d.frame = append(d.frame, payload)
+		}
+	} else if !d.hevc && len(payload) > 0 {
+		// 处理分片单元
+		naluType := payload[0] & 0x1F
+		switch {
+		case naluType >= 1 && naluType <= 23:
+			d.frame = append(d.frame, payload)
+		case naluType == 28: // FU-A分片
+			d.processFU(payload)
+		case naluType == 24: // STAP-A聚合包
+			d.processAggregation(payload, 1)
+		}
+	}
+	if pkt.Marker {
+		d.finishFrame()
+	}
+}
 
-	// 处理分片单元
-	naluType := payload[0] & 0x1F
-	switch {
-	case naluType >= 1 && naluType <= 23:
-		d.writeNALU(payload, int64(pkt.Timestamp))
-	case naluType == 28: // FU-A分片
-		d.processFUA(payload, pkt.Timestamp)
-	case naluType == 24: // STAP-A聚合包
-		d.processSTAPA(payload, pkt.Timestamp)
+// 完整的访问单元才交给receiveCall,不完整的丢弃并请求关键帧
+func (d *H264Depacketizer) finishFrame() {
+	frame := d.frame
+	broken := d.frameBroken || d.fragmentBuffer != nil
+	d.frame = nil
+	d.fragmentBuffer = nil
+	d.hasFrame = false
+	d.frameBroken = false
+	if broken {
+		d.waitKeyFrame = true
+	}
+	if len(frame) == 0 {
+		return
+	}
+	if !broken && d.waitKeyFrame {
+		for _, nalu := range frame {
+			if d.isKeyFrame(nalu) {
+				d.waitKeyFrame = false
+				break
+			}
+		}
+	}
+	if broken || d.waitKeyFrame {
+		d.requestKeyFrame()
+		return
+	}
+	for _, nalu := range frame {
+		d.writeNALU(nalu, int64(d.frameTimestamp))
+	}
+	if d.frameEndCall != nil {
+		d.frameEndCall()
 	}
 }
 
-func (d *H264Depacketizer) processFUA(payload []byte, timestamp uint32) {
-	if len(payload) < 2 {
+// 等关键帧期间每秒最多请求一次
+func (d *H264Depacketizer) requestKeyFrame() {
+	if d.keyFrameCall == nil || time.Since(d.lastKeyRequest) < time.Second {
 		return
 	}
+	d.lastKeyRequest = time.Now()
+	d.keyFrameCall()
+}
+
+func (d *H264Depacketizer) isKeyFrame(nalu []byte) bool {
+	if d.hevc {
+		naluType := (nalu[0] >> 1) & 0x3F
+		return naluType >= 16 && naluType <= 21
+	}
+	return nalu[0]&0x1F == 5
+}
 
-	fuHeader := payload[1]
+// h264为FU-A,h265为FU,还原出nalu头后拼接分片
+func (d *H264Depacketizer) processFU(payload []byte) {
+	var fuHeader byte
+	var naluHeader, data []byte
+	if d.hevc {
+		if len(payload) < 3 {
+			return
+		}
+		fuHeader = payload[2]
+		naluHeader = []byte{(payload[0] & 0x81) | (fuHeader&0x3F)<<1, payload[1]}
+		data = payload[3:]
+	} else {
+		if len(payload) < 2 {
+			return
+		}
+		fuHeader = payload[1]
+		naluHeader = []byte{(payload[0] & 0xE0) | fuHeader&0x1F}
+		data = payload[2:]
+	}
 	start := (fuHeader & 0x80) != 0
 	end := (fuHeader & 0x40) != 0
 
-	nalType := fuHeader & 0x1F
-	naluHeader := (payload[0] & 0xE0) | nalType
-
 	if start {
-		d.fragmentBuffer = []byte{naluHeader}
-		d.fragmentBuffer = append(d.fragmentBuffer, payload[2:]...)
-		d.lastTimestamp = timestamp
-	} else if timestamp == d.lastTimestamp {
-		d.fragmentBuffer = append(d.fragmentBuffer, payload[2:]...)
+		if d.fragmentBuffer != nil {
+			//上一个分片没有结束
+			d.frameBroken = true
+		}
+		d.fragmentBuffer = append(naluHeader, data...)
+	} else if d.fragmentBuffer != nil {
+		d.fragmentBuffer = append(d.fragmentBuffer, data...)
+	} else {
+		//缺少起始分片
+		d.frameBroken = true
+		return
 	}
 
 	if end {
-		if d.fragmentBuffer != nil {
-			d.writeNALU(d.fragmentBuffer, int64(timestamp))
-			d.fragmentBuffer = nil
-		}
+		d.frame = append(d.frame, d.fragmentBuffer)
+		d.fragmentBuffer = nil
 	}
 }
 
-func (d *H264Depacketizer) processSTAPA(payload []byte, timestamp uint32) {
-	offset := 1
-
+// h264的STAP-A或h265的AP,offset为聚合包头长度
+func (d *H264Depacketizer) processAggregation(payload []byte, offset int) {
 	for offset < len(payload) {
 		if offset+2 > len(payload) {
 			break
@@ -184,52 +531,64 @@ func (d *H264Depacketizer) processSTAPA(payload []byte, timestamp uint32) {
 		size := int(binary.BigEndian.Uint16(payload[offset:]))
 		offset += 2
 
-		if offset+size > len(payload) {
+		if offset+size > len(payload) || size == 0 {
+			d.frameBroken = true
 			break
 		}
 
-		d.writeNALU(payload[offset:offset+size], int64(timestamp))
+		d.frame = append(d.frame, payload[offset:offset+size])
 		offset += size
 	}
 }
 
+// nalu对应的receiveCall cmd,不需要输出的返回0
+func (d *H264Depacketizer) naluCmd(nalu []byte) int {
+	if d.hevc {
+		switch naluType := (nalu[0] >> 1) & 0x3F; {
+		case naluType == 32:
+			return ReceiveCmdVps
+		case naluType == 33:
+			return ReceiveCmdSps
+		case naluType == 34:
+			return ReceiveCmdPps
+		case naluType <= 21:
+			return ReceiveCmdVideo
+		}
+		return 0
+	}
+	switch nalu[0] & 0x1F {
+	case 7:
+		return ReceiveCmdSps
+	case 8:
+		return ReceiveCmdPps
+	case 1, 5:
+		return ReceiveCmdVideo
+	}
+	return 0
+}
+
 func (d *H264Depacketizer) writeNALU(nalu []byte, timestamp int64) {
-	naluType := nalu[0] & 0x1F
-	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+	cmd := d.naluCmd(nalu)
+	if cmd == 0 {
+		return
+	}
 	// 提取参数集
-	switch naluType {
-	case 7: // SPS
+	switch cmd {
+	case ReceiveCmdVps:
+		d.vps = append([]byte{}, nalu...)
+		fmt.Printf("Got VPS: %s\n", hex.EncodeToString(nalu))
+	case ReceiveCmdSps:
 		d.sps = append([]byte{}, nalu...)
-		if d.webrtcReceive.receiveCall != nil {
-			d.webrtcReceive.receiveCall(2, nalu, timestamp)
-		}
-
-		if d.writeFile {
-			d.file.Write(startCode)
-			d.file.Write(d.sps)
-		}
 		fmt.Printf("Got SPS: %s\n", hex.EncodeToString(nalu))
-	case 8: // PPS
-		if d.webrtcReceive.receiveCall != nil {
-			d.webrtcReceive.receiveCall(3, nalu, timestamp)
-		}
+	case ReceiveCmdPps:
 		d.pps = append([]byte{}, nalu...)
-		if d.writeFile {
-			d.file.Write(startCode)
-			d.file.Write(d.pps)
-		}
 		fmt.Printf("Got PPS: %s\n", hex.EncodeToString(nalu))
-
 	}
-
-	// 实时解码示例（需实现解码器接口）
-	if naluType == 1 || naluType == 5 {
-		if d.webrtcReceive.receiveCall != nil {
-			d.webrtcReceive.receiveCall(1, nalu, timestamp)
-		}
-		if d.writeFile {
-			d.file.Write(startCode)
-			d.file.Write(nalu)
-		}
+	if d.webrtcReceive.receiveCall != nil {
+		d.webrtcReceive.receiveCall(cmd, nalu, timestamp)
+	}
+	if d.writeFile {
+		d.file.Write([]byte{0x00, 0x00, 0x00, 0x01})
+		d.file.Write(nalu)
 	}
 }
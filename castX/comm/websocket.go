@@ -4,27 +4,38 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"runtime"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
 )
 
 type WsServer struct {
-	loadInitCall      func(data string)            //页面加载完成回调
-	adbConnectCall    func(data string)            //adb连接回调
-	controlCall       func(map[string]interface{}) //控制消息回调
-	usbConnectCall    func(*websocket.Conn)        //usb连接回调
+	loadInitCall      func(data string)             //页面加载完成回调
+	adbConnectCall    func(data string)             //adb连接回调
+	controlCall       func(map[string]interface{})  //控制消息回调
+	usbConnectCall    func(*websocket.Conn)         //usb连接回调
+	shellCall         func(string) (string, error)  //adb shell回调
+	pullCall          func(string, io.Writer) error //adb sync拉取文件回调
 	connectionManager *ConnectionManager
 	webrtcServer      *WebrtcServer
 	config            *Config
 	auth              map[*websocket.Conn]bool
 	tokens            *ttlMap
+	logcat            *Logcat
+	recorder          *Recorder
+	replay            *ReplayBuffer
+	whip              whipPublisher
+	hls               *hlsPackager
+	rtmp              *RtmpPublisher
 }
 
 var upgrader = websocket.Upgrader{
@@ -47,6 +58,13 @@ const (
 	MsgTypeConnectAdb     = "connectAdb"
 	MsgTypeConnectAdbResp = "connectAdbResp"
 	MsgTypeInitConfig     = "initConfig"
+	MsgTypeRecordStart    = "recordStart"
+	MsgTypeRecordStop     = "recordStop"
+	MsgTypeRecordResp     = "recordResp"
+	MsgTypeSaveReplay     = "saveReplay"
+	MsgTypeSaveReplayResp = "saveReplayResp"
+	MsgTypeIceCandidate   = "iceCandidate"
+	MsgTypeBitRateNotify  = "bitRateNotify"
 )
 
 func NewWs(config *Config, webrtcServer *WebrtcServer) *WsServer {
@@ -54,10 +72,19 @@ func NewWs(config *Config, webrtcServer *WebrtcServer) *WsServer {
 	wsServer.config = config
 	wsServer.webrtcServer = webrtcServer
 	wsServer.connectionManager = &ConnectionManager{
-		connections: make(map[*websocket.Conn]bool),
+		connections: make(map[*websocket.Conn]*sync.Mutex),
 	}
 	wsServer.auth = make(map[*websocket.Conn]bool)
 	wsServer.tokens = NewTTLMap(20)
+	wsServer.logcat = NewLogcat(config, wsServer)
+	wsServer.recorder = NewRecorder(config, webrtcServer)
+	wsServer.replay = NewReplayBuffer(config, wsServer.recorder)
+	if config.ReplaySeconds > 0 {
+		wsServer.replay.Start(0)
+	}
+	wsServer.hls = newHlsPackager(config, webrtcServer)
+	wsServer.rtmp = NewRtmpPublisher(config, webrtcServer)
+	webrtcServer.estimateCall = wsServer.BroadcastBitRate
 	return wsServer
 }
 
@@ -68,24 +95,75 @@ func (wsServer *WsServer) SetLoadInitFunc(_loadInit func(string)) {
 func (wsServer *WsServer) SetAdbConnect(_adbConnect func(string)) {
 	wsServer.adbConnectCall = _adbConnect
 }
-func (wsServer *WsServer) SetControlFun(_controlCallFun func(map[string]interface{})) {
+
+// 返回之前的回调,中继结束后用它恢复
+func (wsServer *WsServer) SetControlFun(_controlCallFun func(map[string]interface{})) func(map[string]interface{}) {
+	previous := wsServer.controlCall
 	wsServer.controlCall = _controlCallFun
+	return previous
 }
 func (wsServer *WsServer) SetUsbConnectFun(usbConnectCall func(*websocket.Conn)) {
 	wsServer.usbConnectCall = usbConnectCall
 }
+func (wsServer *WsServer) SetShellFun(_shellCall func(string) (string, error)) {
+	wsServer.shellCall = _shellCall
+}
+
+// 在设备上执行shell命令,没有adb连接时返回错误
+func (wsServer *WsServer) Shell(cmd string) (string, error) {
+	if wsServer.shellCall == nil || !wsServer.config.Info().AdbConnect {
+		return "", errors.New("adb not connect")
+	}
+	return wsServer.shellCall(cmd)
+}
+
+func (wsServer *WsServer) SetPullFun(_pullCall func(string, io.Writer) error) {
+	wsServer.pullCall = _pullCall
+}
+
+// 通过adb sync协议拉取设备上的文件,二进制原样输出
+func (wsServer *WsServer) Pull(path string, w io.Writer) error {
+	if wsServer.pullCall == nil || !wsServer.config.Info().AdbConnect {
+		return errors.New("adb not connect")
+	}
+	return wsServer.pullCall(path, w)
+}
+func (wsServer *WsServer) Logcat() *Logcat {
+	return wsServer.logcat
+}
+func (wsServer *WsServer) Recorder() *Recorder {
+	return wsServer.recorder
+}
+func (wsServer *WsServer) Replay() *ReplayBuffer {
+	return wsServer.replay
+}
+func (wsServer *WsServer) Rtmp() *RtmpPublisher {
+	return wsServer.rtmp
+}
 
 func (wsServer *WsServer) BroadcastInfo() {
+	info := wsServer.config.Info()
 	wsServer.connectionManager.Broadcast(WSMessage{
 		Type: MsgTypeInfoNotify,
 		Data: map[string]interface{}{
-			"orientation": wsServer.config.Orientation,
-			"width":       wsServer.config.ScreenWidth,
-			"height":      wsServer.config.ScreenHeight,
-			"videoHeight": wsServer.config.VideoHeight,
-			"videoWidth":  wsServer.config.VideoWidth,
-			"useAdb":      wsServer.config.UseAdb,
-			"adbConnect":  wsServer.config.AdbConnect,
+			"orientation": info.Orientation,
+			"width":       info.ScreenWidth,
+			"height":      info.ScreenHeight,
+			"videoHeight": info.VideoHeight,
+			"videoWidth":  info.VideoWidth,
+			"useAdb":      info.UseAdb,
+			"adbConnect":  info.AdbConnect,
+		},
+	})
+}
+
+// 通知观看端当前码率和带宽估计
+func (wsServer *WsServer) BroadcastBitRate(bitRate int, estimate int) {
+	wsServer.connectionManager.Broadcast(WSMessage{
+		Type: MsgTypeBitRateNotify,
+		Data: map[string]interface{}{
+			"bitRate":  bitRate,
+			"estimate": estimate,
 		},
 	})
 }
@@ -99,10 +177,25 @@ func (wsServer *WsServer) SendInitConfig(c *websocket.Conn) {
 			"securityKey": wsServer.config.SecurityKey,
 		},
 	}
-	c.WriteJSON(msg)
+	wsServer.connectionManager.Send(c, msg)
 }
 func (wsServer *WsServer) Shutdown() {
 	wsServer.tokens.Close()
+	wsServer.logcat.Stop()
+	if wsServer.recorder.Recording() {
+		wsServer.recorder.Stop()
+	}
+	if wsServer.replay.Running() {
+		wsServer.replay.Stop()
+	}
+	wsServer.hls.Stop()
+	if wsServer.rtmp.Running() {
+		wsServer.rtmp.Stop()
+	}
+	wsServer.webrtcServer.CloseSinks()
+	wsServer.webrtcServer.ClosePeers()
+	wsServer.closeWhip("")
+	wsServer.webrtcServer.CloseIce()
 }
 func (wsServer *WsServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if isPrivateIPv4(r.RemoteAddr) == false {
@@ -125,10 +218,13 @@ func (wsServer *WsServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 	}
 	wsServer.auth[conn] = false
 	wsServer.connectionManager.Add(conn)
+	session := "ws-" + randHex(8) //观看端会话,对应一个webrtc连接
 	defer func() {
 		conn.Close()
 		delete(wsServer.auth, conn)
 		wsServer.connectionManager.Remove(conn)
+		//websocket断开,关闭这个观看端的webrtc连接
+		wsServer.webrtcServer.ClosePeer(session)
 	}()
 	wsServer.SendInitConfig(conn)
 	for {
@@ -147,11 +243,17 @@ func (wsServer *WsServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 			wsServer.handleLogin(conn, msg.Data)
 		//获取webrtc连接
 		case MsgTypeOffer:
-			go wsServer.handleOffer(conn, msg.Data)
+			wsServer.handleOffer(conn, session, msg.Data)
+		case MsgTypeIceCandidate:
+			wsServer.handleIceCandidate(session, msg.Data)
 			//控制命令
 		case MsgTypeControl:
 			wsServer.handleControl(conn, msg.Data)
 			//连接到adb
+		case MsgTypeRecordStart, MsgTypeRecordStop:
+			wsServer.handleRecordMsg(conn, msg)
+		case MsgTypeSaveReplay:
+			go wsServer.handleSaveReplayMsg(conn, msg.Data)
 		case MsgTypeConnectAdb:
 			if wsServer.adbConnectCall != nil {
 				wsServer.adbConnectCall(msg.Data.(string)) // 处理初始化消息，例如设置屏幕尺寸或其他设置
@@ -160,25 +262,102 @@ func (wsServer *WsServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// 浏览器发来的offer,带trickle标记时先回answer,候选地址再通过iceCandidate消息逐个发送
+type offerMsg struct {
+	webrtc.SessionDescription
+	Trickle bool `json:"trickle"`
+}
+
 // HTTP Handler that accepts an Offer and returns an Answer
-// adds outboundVideoTrack to PeerConnection
-func (wsServer *WsServer) handleOffer(conn *websocket.Conn, data interface{}) {
+// adds video/audio tracks to PeerConnection
+func (wsServer *WsServer) handleOffer(conn *websocket.Conn, session string, data interface{}) {
 	dataStr, ok := data.(string)
 	if !ok {
 		return
 	}
-	webRtcSession, err := wsServer.webrtcServer.getSdp(strings.NewReader(dataStr))
-	//response, err := json.Marshal(webRtcSession)
-	if err != nil {
+	var offer offerMsg
+	if err := json.Unmarshal([]byte(dataStr), &offer); err != nil {
+		return
+	}
+	if !offer.Trickle {
+		//老客户端,等候选地址收集完再回复
+		go wsServer.answerOffer(conn, session, offer.SessionDescription, nil)
+		return
+	}
+	//answer发出去之前收集到的候选地址先缓存,避免浏览器在设置远端描述前收到
+	var mu sync.Mutex
+	answered := false
+	var pending []*webrtc.ICECandidate
+	sendCandidate := func(candidate *webrtc.ICECandidate) {
+		var init interface{}
+		if candidate != nil {
+			init = candidate.ToJSON()
+		}
+		wsServer.connectionManager.Send(conn, WSMessage{
+			Type: MsgTypeIceCandidate,
+			Data: map[string]interface{}{"candidate": init},
+		})
+	}
+	//同步处理,保证后面收到的候选地址能找到PeerConnection
+	ok = wsServer.answerOffer(conn, session, offer.SessionDescription, func(candidate *webrtc.ICECandidate) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !answered {
+			pending = append(pending, candidate)
+			return
+		}
+		sendCandidate(candidate)
+	})
+	if !ok {
 		return
 	}
-	conn.WriteJSON(WSMessage{
+	mu.Lock()
+	defer mu.Unlock()
+	answered = true
+	for _, candidate := range pending {
+		sendCandidate(candidate)
+	}
+}
+
+func (wsServer *WsServer) answerOffer(conn *websocket.Conn, session string, offer webrtc.SessionDescription, onCandidate func(*webrtc.ICECandidate)) bool {
+	answer, err := wsServer.webrtcServer.newPeer(session, offer, onCandidate)
+	if err != nil {
+		fmt.Printf("answerOffer err:%+v\r\n", err)
+		return false
+	}
+	wsServer.connectionManager.Send(conn, WSMessage{
 		Type: MsgTypeOfferResp,
 		Data: map[string]interface{}{
 			"GOOS": runtime.GOOS,
-			"sdp":  webRtcSession,
+			"sdp":  answer,
 		},
 	})
+	return true
+}
+
+// 浏览器发来的候选地址,candidate为空表示收集结束
+func (wsServer *WsServer) handleIceCandidate(session string, data interface{}) {
+	dataStr, ok := data.(string)
+	if !ok {
+		return
+	}
+	var msg struct {
+		Candidate *webrtc.ICECandidateInit `json:"candidate"`
+	}
+	if err := json.Unmarshal([]byte(dataStr), &msg); err != nil {
+		return
+	}
+	peerConnection := wsServer.webrtcServer.Peer(session)
+	if peerConnection == nil {
+		return
+	}
+	candidate := webrtc.ICECandidateInit{}
+	if msg.Candidate != nil {
+		candidate = *msg.Candidate
+	}
+	if err := peerConnection.AddICECandidate(candidate); err != nil {
+		fmt.Printf("AddICECandidate err:%+v\r\n", err)
+	}
 }
 
 // 处理控制命令的WebSocket实现
@@ -198,7 +377,7 @@ func (wsServer *WsServer) handleControl(conn *websocket.Conn, data interface{})
 		wsServer.controlCall(controlData)
 	}
 
-	conn.WriteJSON(WSMessage{
+	wsServer.connectionManager.Send(conn, WSMessage{
 		Type: MsgTypeControlResp,
 		Data: map[string]interface{}{
 			"code": 0,
@@ -206,6 +385,45 @@ func (wsServer *WsServer) handleControl(conn *websocket.Conn, data interface{})
 	})
 }
 
+// 开始/停止录制,data可以是{"format":"mkv"}
+func (wsServer *WsServer) handleRecordMsg(conn *websocket.Conn, msg WSMessage) {
+	var err error
+	if msg.Type == MsgTypeRecordStart {
+		var reqData map[string]interface{}
+		if dataStr, ok := msg.Data.(string); ok {
+			json.Unmarshal([]byte(dataStr), &reqData)
+		}
+		format, _ := reqData["format"].(string)
+		err = wsServer.recorder.Start(format)
+	} else {
+		err = wsServer.recorder.Stop()
+	}
+	resp := wsServer.recordStatus()
+	if err != nil {
+		resp["code"] = 1
+		resp["msg"] = err.Error()
+	}
+	wsServer.connectionManager.Send(conn, WSMessage{Type: MsgTypeRecordResp, Data: resp})
+}
+
+// 保存即时回放,data可以是{"format":"mkv"}
+func (wsServer *WsServer) handleSaveReplayMsg(conn *websocket.Conn, data interface{}) {
+	var reqData map[string]interface{}
+	if dataStr, ok := data.(string); ok {
+		json.Unmarshal([]byte(dataStr), &reqData)
+	}
+	format, _ := reqData["format"].(string)
+	resp := map[string]interface{}{"code": 0}
+	name, err := wsServer.replay.Save(format)
+	if err != nil {
+		resp["code"] = 1
+		resp["msg"] = err.Error()
+	} else {
+		resp["file"] = name
+	}
+	wsServer.connectionManager.Send(conn, WSMessage{Type: MsgTypeSaveReplayResp, Data: resp})
+}
+
 func (wsServer *WsServer) handleLogin(conn *websocket.Conn, data interface{}) {
 	//解析参数
 	dataStr, ok := data.(string)
@@ -232,22 +450,20 @@ func (wsServer *WsServer) handleLogin(conn *websocket.Conn, data interface{}) {
 		//已经使用直接关闭
 		return
 	}
-	wsServer.tokens.Add(reqToken, 1)
 	timestamp, ok := reqData["timestamp"].(float64)
-
-	var srcData = wsServer.config.SecurityKey + "|" + strconv.FormatInt(int64(timestamp), 10) + "|" + wsServer.config.Password
-	sum := sha256.Sum256([]byte(srcData))
-	token := hex.EncodeToString(sum[:])
-	//2秒内有效
-	if token == reqToken && math.Abs(timestamp-float64(time.Now().UnixMilli())) < 10*1000 {
+	if wsServer.verifyToken(reqToken, timestamp) {
 		wsServer.auth[conn] = true
 	}
 
-	conn.WriteJSON(WSMessage{
+	resp := map[string]interface{}{
+		"auth": wsServer.auth[conn],
+	}
+	if wsServer.auth[conn] {
+		resp["iceServers"] = wsServer.config.IceServerList()
+	}
+	wsServer.connectionManager.Send(conn, WSMessage{
 		Type: MsgTypeLoginAuthResp,
-		Data: map[string]interface{}{
-			"auth": wsServer.auth[conn],
-		},
+		Data: resp,
 	})
 	if wsServer.auth[conn] {
 		//广播配置信息
@@ -255,3 +471,15 @@ func (wsServer *WsServer) handleLogin(conn *websocket.Conn, data interface{}) {
 	}
 	return
 }
+
+// 校验登录token,每个token只能使用一次
+func (wsServer *WsServer) verifyToken(reqToken string, timestamp float64) bool {
+	if len(reqToken) == 0 || !wsServer.tokens.AddIfNotExists(reqToken, 1) {
+		return false
+	}
+	var srcData = wsServer.config.SecurityKey + "|" + strconv.FormatInt(int64(timestamp), 10) + "|" + wsServer.config.Password
+	sum := sha256.Sum256([]byte(srcData))
+	token := hex.EncodeToString(sum[:])
+	//10秒内有效
+	return token == reqToken && math.Abs(timestamp-float64(time.Now().UnixMilli())) < 10*1000
+}
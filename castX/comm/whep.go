@@ -0,0 +1,106 @@
+package comm
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+WHEP播放接口(draft-ietf-wish-whep)
+POST application/sdp的offer,返回201和answer,Location指向会话地址,DELETE会话地址结束播放
+连接登记在WebrtcServer里,会话名加whep-前缀和websocket观看端区分
+*/
+const whepSessionPrefix = "whep-"
+
+/*
+WHEP/WHIP客户端一般只能带Bearer token,token为StreamToken,没有设置时用连接密码,
+建议单独设置StreamToken,避免连接密码出现在每个请求头里;也兼容其他http接口的token/timestamp方式
+没有设置密码和StreamToken时不鉴权(只限局域网),推流接口见checkWhipAuth
+*/
+func (wsServer *WsServer) checkBearerAuth(w http.ResponseWriter, r *http.Request) bool {
+	if isPrivateIPv4(r.RemoteAddr) == false {
+		http.Error(w, "Access denied. Only IPv4 LAN allowed.", http.StatusForbidden)
+		return false
+	}
+	if id := r.PathValue("id"); id != "" && !wsServer.config.MatchDevice(id) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return false
+	}
+	streamToken := wsServer.streamToken()
+	if len(streamToken) == 0 {
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(streamToken)) == 1 {
+		return true
+	}
+	return wsServer.checkHttpAuth(w, r)
+}
+
+// 推流会替换画面,没有设置密码和StreamToken时拒绝
+func (wsServer *WsServer) checkWhipAuth(w http.ResponseWriter, r *http.Request) bool {
+	if len(wsServer.streamToken()) == 0 {
+		http.Error(w, "whip requires password or stream token", http.StatusForbidden)
+		return false
+	}
+	return wsServer.checkBearerAuth(w, r)
+}
+
+func (wsServer *WsServer) streamToken() string {
+	if len(wsServer.config.StreamToken) > 0 {
+		return wsServer.config.StreamToken
+	}
+	return wsServer.config.Password
+}
+
+// POST /whep 或 /api/devices/{id}/whep
+func (wsServer *WsServer) handleWhep(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkBearerAuth(w, r) {
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "content type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	id := randHex(16)
+	answer, err := wsServer.webrtcServer.newPeer(whepSessionPrefix+id, offer, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// DELETE /whep/{session}
+func (wsServer *WsServer) handleWhepDelete(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkBearerAuth(w, r) {
+		return
+	}
+	if !wsServer.webrtcServer.ClosePeer(whepSessionPrefix + r.PathValue("session")) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// OPTIONS预检,告诉客户端支持的格式,WHEP和WHIP共用
+func (wsServer *WsServer) handleWhepOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Post", "application/sdp")
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,402 @@
+package comm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+WHIP推流接口(RFC 9725),浏览器或者OBS可以把h264/opus推进来,
+拆包后和scrcpy一样送进WebrtcServer,webrtc观看、录制等输出都能直接使用
+推流期间独占来源,本地来源或者中继正在推流时拒绝
+同一时间只允许一个推流端
+*/
+const whipSource = "whip"
+
+type whipPublisher struct {
+	mu             sync.Mutex
+	id             string
+	peerConnection *webrtc.PeerConnection
+	pending        bool   //正在协商,其他推流请求直接拒绝
+	keyFrameSaved  bool   //关键帧请求被推流端接管
+	keyFrameCall   func() //接管前的关键帧请求回调,推流结束时恢复
+}
+
+// rtp时间戳展开成不回绕的int64
+type rtpClock struct {
+	started bool
+	last    uint32
+	value   int64
+}
+
+func (clock *rtpClock) unwrap(timestamp uint32) int64 {
+	if !clock.started {
+		clock.started = true
+		clock.last = timestamp
+		return 0
+	}
+	clock.value += int64(int32(timestamp - clock.last))
+	clock.last = timestamp
+	return clock.value
+}
+
+/*
+同一个推流端各轨道共用的时间轴,把各自的rtp时间戳换算成同一个时钟的微秒,音视频才能同步
+每个轨道先按第一个包的到达时间对齐,收到发送端报告(SR)后按里面的ntp/rtp对应关系校正
+*/
+type mediaClock struct {
+	mu        sync.Mutex
+	start     time.Time //第一个包的到达时间,时间轴的0点
+	started   bool
+	ntpOrigin int64 //时间轴0点对应的ntp时间(微秒)
+	hasNtp    bool
+}
+
+type trackClock struct {
+	sync   *mediaClock
+	rate   int64
+	clock  rtpClock
+	offset int64 //第一个包相对时间轴0点的微秒
+	srRtp  int64 //最近一次SR里的rtp时间戳(展开后)
+	srTime int64 //最近一次SR在时间轴上的微秒
+	hasSr  bool
+	last   int64
+}
+
+func (sync *mediaClock) track(rate int64) *trackClock {
+	return &trackClock{sync: sync, rate: rate}
+}
+
+// rtp时间戳换算成时间轴上的微秒,保证单调不减
+func (clock *trackClock) timestamp(rtpTimestamp uint32) int64 {
+	clock.sync.mu.Lock()
+	defer clock.sync.mu.Unlock()
+	now := time.Now()
+	if !clock.sync.started {
+		clock.sync.started = true
+		clock.sync.start = now
+	}
+	first := !clock.clock.started
+	value := clock.clock.unwrap(rtpTimestamp)
+	if first {
+		clock.offset = now.Sub(clock.sync.start).Microseconds()
+	}
+	var timestamp int64
+	if clock.hasSr {
+		timestamp = clock.srTime + (value-clock.srRtp)*1000000/clock.rate
+	} else {
+		timestamp = clock.offset + value*1000000/clock.rate
+	}
+	//SR校正可能让时间往回跳,不能比已经输出的小
+	if timestamp < clock.last {
+		timestamp = clock.last
+	}
+	clock.last = timestamp
+	return timestamp
+}
+
+// 发送端报告,ntpTime为64位ntp时间,和rtpTime是同一时刻
+func (clock *trackClock) senderReport(ntpTime uint64, rtpTime uint32) {
+	clock.sync.mu.Lock()
+	defer clock.sync.mu.Unlock()
+	if !clock.clock.started {
+		return
+	}
+	value := clock.clock.value + int64(int32(rtpTime-clock.clock.last))
+	ntp := int64(ntpTime>>32)*1000000 + int64((ntpTime&0xFFFFFFFF)*1000000>>32)
+	if !clock.sync.hasNtp {
+		//第一个SR按当前的对齐方式确定ntp和时间轴的关系,之后各轨道都按ntp换算
+		current := clock.offset + value*1000000/clock.rate
+		if clock.hasSr {
+			current = clock.srTime + (value-clock.srRtp)*1000000/clock.rate
+		}
+		clock.sync.ntpOrigin = ntp - current
+		clock.sync.hasNtp = true
+	}
+	clock.srRtp = value
+	clock.srTime = ntp - clock.sync.ntpOrigin
+	clock.hasSr = true
+}
+
+// 把同一时间戳的nalu拼成一帧再送给WebrtcServer
+type whipVideoWriter struct {
+	webrtcServer *WebrtcServer
+	source       string //独占来源的名字
+	clock        *trackClock
+	frame        bytes.Buffer
+	timestamp    int64
+	hasFrame     bool
+}
+
+func (writer *whipVideoWriter) writeNalu(cmd int, nalu []byte, rtpTimestamp int64) {
+	timestamp := writer.clock.timestamp(uint32(rtpTimestamp))
+	if writer.hasFrame && timestamp != writer.timestamp {
+		writer.flush()
+	}
+	writer.timestamp = timestamp
+	writer.hasFrame = true
+	writer.frame.Write([]byte{0x00, 0x00, 0x00, 0x01})
+	writer.frame.Write(nalu)
+}
+
+func (writer *whipVideoWriter) flush() {
+	if !writer.hasFrame {
+		return
+	}
+	writer.webrtcServer.sendVideoFrom(writer.source, append([]byte(nil), writer.frame.Bytes()...), writer.timestamp)
+	writer.frame.Reset()
+	writer.hasFrame = false
+}
+
+// 只接受h264和opus,避免协商出服务端无法转发的编码
+func newWhipMediaEngine() (*webrtc.MediaEngine, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}},
+		},
+		PayloadType: 102,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	return mediaEngine, nil
+}
+
+// POST /whip 或 /api/devices/{id}/whip
+func (wsServer *WsServer) handleWhip(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkWhipAuth(w, r) {
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "content type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !strings.EqualFold(wsServer.webrtcServer.MimeType(), webrtc.MimeTypeH264) {
+		http.Error(w, "server video codec is not h264", http.StatusNotAcceptable)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	publisher := &wsServer.whip
+	publisher.mu.Lock()
+	if publisher.peerConnection != nil || publisher.pending {
+		publisher.mu.Unlock()
+		http.Error(w, "already publishing", http.StatusConflict)
+		return
+	}
+	if err := wsServer.webrtcServer.acquireSource(whipSource); err != nil {
+		publisher.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	publisher.pending = true
+	publisher.mu.Unlock()
+	//协商和收集候选地址时不持有锁,不影响DELETE
+	id := randHex(16)
+	peerConnection, status, err := wsServer.newWhipPeer(id, string(body))
+	publisher.mu.Lock()
+	publisher.pending = false
+	if err != nil {
+		publisher.mu.Unlock()
+		wsServer.restoreWhipKeyFrame()
+		wsServer.webrtcServer.releaseSource(whipSource)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	publisher.id = id
+	publisher.peerConnection = peerConnection
+	publisher.mu.Unlock()
+	//收集候选地址期间连接已经失败的直接结束
+	if state := peerConnection.ConnectionState(); state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+		wsServer.closeWhip(id)
+		http.Error(w, "whip connection "+state.String(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, peerConnection.LocalDescription().SDP)
+}
+
+// 创建推流连接并等待候选地址收集完成,出错时返回http状态码
+func (wsServer *WsServer) newWhipPeer(id string, sdp string) (*webrtc.PeerConnection, int, error) {
+	mediaEngine, err := newWhipMediaEngine()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	iceTransport, err := wsServer.webrtcServer.IceTransport()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	api, err := iceTransport.NewAPI(mediaEngine)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	peerConnection, err := api.NewPeerConnection(wsServer.config.WebrtcConfiguration())
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	clock := &mediaClock{}
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		fmt.Printf("whip track:%s\r\n", track.Codec().MimeType)
+		trackClock := clock.track(int64(track.Codec().ClockRate))
+		go readWhipRTCP(receiver, track, trackClock)
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			go wsServer.readWhipVideo(peerConnection, track, trackClock)
+		} else {
+			go wsServer.readWhipAudio(track, trackClock)
+		}
+	})
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			wsServer.closeWhip(id)
+		}
+	})
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err = peerConnection.SetRemoteDescription(offer); err != nil {
+		peerConnection.Close()
+		return nil, http.StatusBadRequest, err
+	}
+	gatherCompletePromise := webrtc.GatheringCompletePromise(peerConnection)
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err == nil {
+		err = peerConnection.SetLocalDescription(answer)
+	}
+	if err != nil {
+		peerConnection.Close()
+		return nil, http.StatusBadRequest, err
+	}
+	<-gatherCompletePromise
+	return peerConnection, http.StatusCreated, nil
+}
+
+// DELETE /whip/{session}
+func (wsServer *WsServer) handleWhipDelete(w http.ResponseWriter, r *http.Request) {
+	if !wsServer.checkWhipAuth(w, r) {
+		return
+	}
+	if !wsServer.closeWhip(r.PathValue("session")) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// 结束推流,id为空时关闭当前推流
+func (wsServer *WsServer) closeWhip(id string) bool {
+	publisher := &wsServer.whip
+	publisher.mu.Lock()
+	peerConnection := publisher.peerConnection
+	if peerConnection == nil || (len(id) > 0 && id != publisher.id) {
+		publisher.mu.Unlock()
+		return false
+	}
+	publisher.peerConnection = nil
+	publisher.id = ""
+	publisher.mu.Unlock()
+	wsServer.restoreWhipKeyFrame()
+	peerConnection.Close()
+	wsServer.webrtcServer.StreamEnd()
+	wsServer.webrtcServer.releaseSource(whipSource)
+	return true
+}
+
+// 观看端请求关键帧时转成给推流端的PLI,推流结束时恢复原来的回调
+func (wsServer *WsServer) takeWhipKeyFrame(requestKeyFrame func()) {
+	publisher := &wsServer.whip
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	previous := wsServer.webrtcServer.SetKeyFrameRequestFun(requestKeyFrame)
+	if !publisher.keyFrameSaved {
+		publisher.keyFrameSaved = true
+		publisher.keyFrameCall = previous
+	}
+}
+
+func (wsServer *WsServer) restoreWhipKeyFrame() {
+	publisher := &wsServer.whip
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if publisher.keyFrameSaved {
+		wsServer.webrtcServer.SetKeyFrameRequestFun(publisher.keyFrameCall)
+		publisher.keyFrameSaved = false
+		publisher.keyFrameCall = nil
+	}
+}
+
+func (wsServer *WsServer) readWhipVideo(peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote, clock *trackClock) {
+	writer := &whipVideoWriter{webrtcServer: wsServer.webrtcServer, source: whipSource, clock: clock}
+	receive := &WebrtcReceive{receiveCall: writer.writeNalu}
+	depacketizer := NewH264Depacketizer(receive, false)
+	depacketizer.frameEndCall = writer.flush
+	//丢包或者还没收到关键帧时depacketizer会请求,观看端需要关键帧时也转给推流端
+	requestKeyFrame := func() {
+		peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+	}
+	depacketizer.keyFrameCall = requestKeyFrame
+	wsServer.takeWhipKeyFrame(requestKeyFrame)
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			writer.flush()
+			return
+		}
+		depacketizer.ProcessRTP(packet)
+	}
+}
+
+// opus一个rtp包就是一个完整的opus包,只需要换算时间戳
+func (wsServer *WsServer) readWhipAudio(track *webrtc.TrackRemote, clock *trackClock) {
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus) {
+		return
+	}
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if len(packet.Payload) > 0 {
+			wsServer.webrtcServer.sendAudioFrom(whipSource, packet.Payload, clock.timestamp(packet.Timestamp))
+		}
+	}
+}
+
+// 读取推流端的rtcp,用发送端报告校正时间轴
+func readWhipRTCP(receiver *webrtc.RTPReceiver, track *webrtc.TrackRemote, clock *trackClock) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if sr, ok := packet.(*rtcp.SenderReport); ok && sr.SSRC == uint32(track.SSRC()) {
+				clock.senderReport(sr.NTPTime, sr.RTPTime)
+			}
+		}
+	}
+}
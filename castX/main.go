@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
+	"os/exec"
+	"sync"
 
 	"github.com/dosgo/castX/castxServer"
 	"github.com/dosgo/castX/comm"
@@ -12,8 +15,16 @@ import (
 )
 
 var framerate = 30
+var bitRate = 4000000
+var abr = false
+var ffmpegCmd *exec.Cmd
+var ffmpegMu sync.Mutex
 
 func main() {
+	rtspPort := flag.Int("rtsp", 0, "rtsp port, 0 disable")
+	abrMode := flag.String("abr", "", "adaptive bitrate min|median, empty disable (restarts ffmpeg on each change)")
+	flag.IntVar(&bitRate, "bitrate", bitRate, "start bitrate with -abr")
+	flag.Parse()
 
 	bounds := screenshot.GetDisplayBounds(0)
 	castx, _ := castxServer.Start(8081, bounds.Dx(), bounds.Dy(), "", false, "123456", 0)
@@ -28,15 +39,78 @@ func main() {
 		}
 	})
 
+	/*
+		自适应码率默认关闭,用crf编码
+		ffmpeg命令行运行中无法修改码率,开启后每次调整都要重启ffmpeg,画面会中断一下并从新的关键帧开始,
+		只适合带宽变化不频繁的场景
+	*/
+	if *abrMode != "" {
+		abr = true
+		castx.Config.AbrMode = *abrMode
+		castx.Config.SetBitRate(bitRate)
+		castx.WebrtcServer.SetBitRateFun(func(rate int) {
+			ffmpegMu.Lock()
+			bitRate = rate
+			cmd := ffmpegCmd
+			ffmpegMu.Unlock()
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+		}, true)
+	}
+	if *rtspPort > 0 {
+		if err := castx.StartRtsp(*rtspPort); err != nil {
+			fmt.Printf("rtsp start err:%+v\r\n", err)
+		}
+	}
 	go ffmpegDesktop(false, castx.WebrtcServer)
 	fmt.Scanln()
 }
 
-/*启动录屏*/
+/*启动录屏,开启自适应码率时码率变化后重新启动*/
 func ffmpegDesktop(audio bool, webrtcServer *comm.WebrtcServer) {
+	for {
+		ffmpegMu.Lock()
+		rate := bitRate
+		ffmpegMu.Unlock()
+		cmd := ffmpegDesktopCmd(audio, rate, webrtcServer)
+		ffmpegMu.Lock()
+		ffmpegCmd = cmd
+		ffmpegMu.Unlock()
+		err := cmd.Run()
+		ffmpegMu.Lock()
+		restart := rate != bitRate
+		ffmpegMu.Unlock()
+		if !restart {
+			fmt.Printf("ffmpeg exit err:%+v\r\n", err)
+			return
+		}
+		fmt.Printf("ffmpeg restart bitRate:%d\r\n", bitRate)
+	}
+}
+
+func ffmpegDesktopCmd(audio bool, rate int, webrtcServer *comm.WebrtcServer) *exec.Cmd {
 	h264Buf := comm.NewMemoryWriter(webrtcServer, framerate)
 	var stream []*ffmpeg.Stream
 	var ioW []io.Writer
+	outputArgs := ffmpeg.KwArgs{
+		"map":         "0:v",
+		"preset":      "ultrafast",     // 最快编码
+		"tune":        "zerolatency",   // 零延迟模式
+		"x264-params": "no-scenecut=1", // 零延迟模式
+		"g":           framerate * 2,   // ffmpeg命令行无法按需输出关键帧,限制GOP长度让新观看端尽快出画面
+		//"profile:v": "baseline",                 // 基线档次
+		"pix_fmt":  "yuv420p",                  // 像素格式
+		"f":        "h264",                     // 原始H264输出
+		"movflags": "frag_keyframe+empty_moov", // 流式优化
+	}
+	if abr {
+		outputArgs["b:v"] = rate
+		outputArgs["maxrate"] = rate
+		outputArgs["bufsize"] = rate / 2
+	} else {
+		outputArgs["crf"] = "28"
+	}
 	// 使用ffmpeg-go捕获屏幕并编码为H264
 	videoOutput := ffmpeg.Input("desktop",
 		ffmpeg.KwArgs{
@@ -44,18 +118,7 @@ func ffmpegDesktop(audio bool, webrtcServer *comm.WebrtcServer) {
 			"framerate": framerate, // 帧率
 			//"video_size": fmt.Sprintf("%dx%d", width, height), // 分辨率
 		}).
-		Output("pipe:1", // 输出到标准输出
-			ffmpeg.KwArgs{
-				"crf":         "28",
-				"map":         "0:v",
-				"preset":      "ultrafast",     // 最快编码
-				"tune":        "zerolatency",   // 零延迟模式
-				"x264-params": "no-scenecut=1", // 零延迟模式
-				//"profile:v": "baseline",                 // 基线档次
-				"pix_fmt":  "yuv420p",                  // 像素格式
-				"f":        "h264",                     // 原始H264输出
-				"movflags": "frag_keyframe+empty_moov", // 流式优化
-			})
+		Output("pipe:1", outputArgs) // 输出到标准输出
 	stream = append(stream, videoOutput)
 	ioW = append(ioW, h264Buf)
 	if audio {
@@ -77,6 +140,6 @@ func ffmpegDesktop(audio bool, webrtcServer *comm.WebrtcServer) {
 		ioW = append(ioW, audioWriter)
 	}
 
-	ffmpeg.MergeOutputs(stream...).WithOutput(ioW...).OverWriteOutput().
-		Run()
+	return ffmpeg.MergeOutputs(stream...).WithOutput(ioW...).OverWriteOutput().
+		Compile()
 }
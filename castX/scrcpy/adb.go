@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -11,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dosgo/castX/comm"
 	"github.com/dosgo/castX/static"
 	"github.com/dosgo/libadb"
 	"github.com/gorilla/websocket"
@@ -37,7 +39,7 @@ func (scrcpyClient *ScrcpyClient) InitAdb(peerName string, savPath string, rever
 						var connectPort = dataInfo["connectPort"].(float64)
 
 						//已经连接
-						if scrcpyClient.castx.Config.AdbConnect {
+						if scrcpyClient.castx.Config.Info().AdbConnect {
 							return
 						}
 						connected := adbClient.Connect(fmt.Sprintf("%s:%d", address, int(connectPort)))
@@ -63,6 +65,12 @@ func (scrcpyClient *ScrcpyClient) InitAdb(peerName string, savPath string, rever
 		}
 	})
 
+	scrcpyClient.castx.WsServer.SetShellFun(adbClient.Shell)
+	scrcpyClient.castx.WsServer.SetPullFun(func(path string, w io.Writer) error {
+		_, err := adbClient.PullStream(path, w)
+		return err
+	})
+
 	scrcpyClient.castx.WsServer.SetUsbConnectFun(func(usbConn *websocket.Conn) {
 
 		netConn := NewWebsocketConnAdapter(usbConn)
@@ -80,10 +88,9 @@ func (scrcpyClient *ScrcpyClient) adbConnectOk(adbClient *libadb.AdbClient, savP
 	if scrcpyClient.castx.Config.MaxSize > 0 {
 		maxSize = fmt.Sprintf("max_size=%d", int(scrcpyClient.castx.Config.MaxSize))
 	}
-	scrcpyClient.castx.ScrcpyReceiver.Counter = 0 //重置接收计数器很重要
 	go func() {
 		defer func() {
-			scrcpyClient.castx.Config.AdbConnect = false
+			scrcpyClient.castx.Config.UpdateInfo(func(info *comm.ScreenInfo) { info.AdbConnect = false })
 			scrcpyClient.castx.WsServer.BroadcastInfo()
 		}()
 		localFile := fmt.Sprintf("%sscrcpy-server-v3.1", savPath)
@@ -91,20 +98,31 @@ func (scrcpyClient *ScrcpyClient) adbConnectOk(adbClient *libadb.AdbClient, savP
 		pushErr := adbClient.Push(localFile, "/data/local/tmp/scrcpy-server", 0644)
 		fmt.Printf("pushErr:%+v\r\n", pushErr)
 
-		scid := GenerateSCID()
-		reverseErr := adbClient.Reverse(fmt.Sprintf("localabstract:scrcpy_%s", scid), fmt.Sprintf("tcp:%d", reversePort))
-		fmt.Printf("ReverseErr:%+v\r\n", reverseErr)
-
-		//repeat-previous-frame-after=0
-		// audio-output-buffer=100 --audio-buffer=100
-		//'profile=4200,b-frames=0,preset=ultrafast'
-		//repeat-previous-frame-after=5
-		cmd := fmt.Sprintf("CLASSPATH=/data/local/tmp/scrcpy-server app_process / com.genymobile.scrcpy.Server 3.1 scid=%s  log_level=debug cleanup=true video_bit_rate=4000000  video_codec_options=profile=65536 %s", scid, maxSize)
-		adbClient.ShellCmd(cmd, true)
+		for {
+			scrcpyClient.castx.ScrcpyReceiver.Counter = 0 //重置接收计数器很重要
+			scid := GenerateSCID()
+			reverseErr := adbClient.Reverse(fmt.Sprintf("localabstract:scrcpy_%s", scid), fmt.Sprintf("tcp:%d", reversePort))
+			fmt.Printf("ReverseErr:%+v\r\n", reverseErr)
 
+			bitRate := scrcpyClient.castx.Config.BitRate()
+			if bitRate <= 0 {
+				bitRate = 4000000
+			}
+			//repeat-previous-frame-after=0
+			// audio-output-buffer=100 --audio-buffer=100
+			//'profile=4200,b-frames=0,preset=ultrafast'
+			//repeat-previous-frame-after=5
+			cmd := fmt.Sprintf("CLASSPATH=/data/local/tmp/scrcpy-server app_process / com.genymobile.scrcpy.Server 3.1 scid=%s  log_level=debug cleanup=true video_bit_rate=%d  video_codec_options=profile=65536 %s", scid, bitRate, maxSize)
+			adbClient.ShellCmd(cmd, true)
+			//码率调整导致的退出,重新启动
+			if !scrcpyClient.restart.Swap(false) {
+				return
+			}
+		}
 	}()
-	scrcpyClient.castx.Config.AdbConnect = true
+	scrcpyClient.castx.Config.UpdateInfo(func(info *comm.ScreenInfo) { info.AdbConnect = true })
 	scrcpyClient.castx.WsServer.BroadcastInfo()
+	scrcpyClient.castx.WsServer.Logcat().StartCapture()
 }
 func writeIfMD5Mismatch(localPath string) error {
 	embedData, err := static.StaticFiles.ReadFile(filepath.Base(localPath))
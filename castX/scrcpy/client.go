@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/dosgo/castX/castxServer"
 )
@@ -13,6 +14,7 @@ import (
 type ScrcpyClient struct {
 	controlConn net.Conn
 	castx       *castxServer.Castx
+	restart     atomic.Bool //服务端退出后按新参数重新启动
 }
 
 func NewScrcpyClient(webPort int, peerName string, savaPath string, password string) *ScrcpyClient {
@@ -33,6 +35,12 @@ func (scrcpyClient *ScrcpyClient) StartClient() {
 			controlCall(controlConn, scrcpyClient.castx.Config, controlData)
 		}
 	})
+	//观看端丢包或者刚加入时请求关键帧
+	scrcpyClient.castx.WebrtcServer.SetKeyFrameRequestFun(func() {
+		SendResetVideo(scrcpyClient.getControlConn())
+	})
+	//带宽变化时调整码率
+	scrcpyClient.castx.WebrtcServer.SetBitRateFun(scrcpyClient.setBitRate, true)
 	scrcpyClient.castx.SetControlConnectCall(func(c net.Conn) {
 		scrcpyClient.controlConn = c
 		handleControl(c)
@@ -40,6 +48,18 @@ func (scrcpyClient *ScrcpyClient) StartClient() {
 
 }
 
+// scrcpy不支持运行中修改码率,关闭控制连接让服务端退出,再按新码率启动
+func (scrcpyClient *ScrcpyClient) setBitRate(bitRate int) {
+	fmt.Printf("setBitRate:%d\r\n", bitRate)
+	scrcpyClient.castx.Config.SetBitRate(bitRate)
+	controlConn := scrcpyClient.getControlConn()
+	if !scrcpyClient.castx.Config.Info().AdbConnect || controlConn == nil {
+		return
+	}
+	scrcpyClient.restart.Store(true)
+	controlConn.Close()
+}
+
 func (scrcpyClient *ScrcpyClient) Shutdown() {
 	if scrcpyClient.castx != nil {
 		scrcpyClient.castx.HttpServer.Shutdown()
@@ -48,6 +68,8 @@ func (scrcpyClient *ScrcpyClient) Shutdown() {
 		scrcpyClient.castx.WsServer.Shutdown()
 	}
 	scrcpyClient.castx.CloseScrcpyReceiver()
+	scrcpyClient.castx.CloseRtsp()
+	scrcpyClient.castx.CloseTurn()
 }
 
 // 处理控制数据（示例解析基本控制指令）
@@ -86,16 +86,24 @@ func SendDisplayPower(controlConn net.Conn, on byte) {
 	}
 }
 
+// 重置编码器,scrcpy会马上输出带sps/pps的关键帧
+func SendResetVideo(controlConn net.Conn) {
+	if controlConn != nil {
+		controlConn.Write([]byte{byte(TYPE_RESET_VIDEO)})
+	}
+}
+
 func controlCall(controlConn net.Conn, config *comm.Config, controlData map[string]interface{}) {
+	screen := config.Info()
 
 	if controlData["type"] == "left" {
 		if f, ok := controlData["x"].(float64); ok {
 			x := uint32(f)
 			y := uint32(controlData["y"].(float64))
 			var pointerId uint64 = 0
-			SendKTouchEvent(controlConn, ACTION_DOWN, pointerId, x, y, uint16(config.ScreenWidth), uint16(config.ScreenHeight), uint16(mtRand(100, 200)))
+			SendKTouchEvent(controlConn, ACTION_DOWN, pointerId, x, y, uint16(screen.ScreenWidth), uint16(screen.ScreenHeight), uint16(mtRand(100, 200)))
 			time.Sleep(time.Millisecond * time.Duration(mtRand(50, 90))) // 等待100毫秒
-			SendKTouchEvent(controlConn, ACTION_UP, pointerId, x, y, uint16(config.ScreenWidth), uint16(config.ScreenHeight), uint16(mtRand(100, 200)))
+			SendKTouchEvent(controlConn, ACTION_UP, pointerId, x, y, uint16(screen.ScreenWidth), uint16(screen.ScreenHeight), uint16(mtRand(100, 200)))
 		}
 	}
 	if controlData["type"] == "swipe" {
@@ -109,7 +117,7 @@ func controlCall(controlConn net.Conn, config *comm.Config, controlData map[stri
 			x := uint32(f)
 			y := uint32(controlData["y"].(float64))
 			var pointerId uint64 = 0
-			SendKTouchEvent(controlConn, ACTION_DOWN, pointerId, x, y, uint16(config.ScreenWidth), uint16(config.ScreenHeight), uint16(mtRand(100, 200)))
+			SendKTouchEvent(controlConn, ACTION_DOWN, pointerId, x, y, uint16(screen.ScreenWidth), uint16(screen.ScreenHeight), uint16(mtRand(100, 200)))
 			fmt.Printf("panstart:%d,%d\r\n", x, y) // 打印 x 和 y 的值，用于调试，你可以根据需要修改打印 forma
 		}
 	}
@@ -118,7 +126,7 @@ func controlCall(controlConn net.Conn, config *comm.Config, controlData map[stri
 			x := uint32(f)
 			y := uint32(controlData["y"].(float64))
 			var pointerId uint64 = 0
-			SendKTouchEvent(controlConn, ACTION_MOVE, pointerId, x, y, uint16(config.ScreenWidth), uint16(config.ScreenHeight), uint16(mtRand(100, 200)))
+			SendKTouchEvent(controlConn, ACTION_MOVE, pointerId, x, y, uint16(screen.ScreenWidth), uint16(screen.ScreenHeight), uint16(mtRand(100, 200)))
 			fmt.Printf("pan:%d,%d\r\n", x, y)
 		}
 	}
@@ -127,7 +135,7 @@ func controlCall(controlConn net.Conn, config *comm.Config, controlData map[stri
 			x := uint32(f)
 			y := uint32(controlData["y"].(float64))
 			var pointerId uint64 = 0
-			SendKTouchEvent(controlConn, ACTION_UP, pointerId, x, y, uint16(config.ScreenWidth), uint16(config.ScreenHeight), uint16(mtRand(100, 200)))
+			SendKTouchEvent(controlConn, ACTION_UP, pointerId, x, y, uint16(screen.ScreenWidth), uint16(screen.ScreenHeight), uint16(mtRand(100, 200)))
 			fmt.Printf("panend:%d,%d\r\n", x, y)
 		}
 	}
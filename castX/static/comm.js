@@ -24,6 +24,10 @@ ws.onmessage = (event) => {
     if (msg.type === 'offerResponse') {
         pc.setRemoteDescription(msg.data.sdp);
     }
+    //服务端的候选地址,candidate为null表示收集结束
+    if (msg.type === 'iceCandidate') {
+        pc.addIceCandidate(msg.data.candidate || {candidate: ''}).catch(e => log(e));
+    }
     if (msg.type === 'infoNotify') {
         orientation = msg.data.orientation;
         nativeWidth  = msg.data.width;
@@ -47,6 +51,12 @@ ws.onmessage = (event) => {
             canvasSizev1(); // 
         }
     }
+    //当前码率和带宽估计
+    if (msg.type === 'bitRateNotify') {
+        if (typeof videoVm !== 'undefined'){
+            videoVm.bitRate=(msg.data.bitRate/1000000).toFixed(1)+'/'+(msg.data.estimate/1000000).toFixed(1)+' Mbps';
+        }
+    }
     //初始化配置
     if (msg.type === 'initConfig') {
         securityKey  = msg.data.securityKey;
@@ -68,7 +78,7 @@ ws.onmessage = (event) => {
                 videoVm.isAuth=true;
                 videoVm.errorMessage="";
             }
-            initWebRTC();
+            initWebRTC(msg.data.iceServers || []);
         }else{
             if (typeof videoVm !== 'undefined'){
                 videoVm.errorMessage=getLang('loginErrMsg');
@@ -87,12 +97,19 @@ function login() {
         data: JSON.stringify(args)
     }));
 }
-function initWebRTC() {
-    pc = new RTCPeerConnection()
+function initWebRTC(iceServers) {
+    pc = new RTCPeerConnection({iceServers})
     pc.addTransceiver('video')
     pc.addTransceiver('audio')
 
     pc.oniceconnectionstatechange = () => log(pc.iceConnectionState)
+    //trickle ice,本地候选地址逐个发给服务端
+    pc.onicecandidate = (event) => {
+        ws.send(JSON.stringify({
+            type: 'iceCandidate',
+            data: JSON.stringify({candidate: event.candidate ? event.candidate.toJSON() : null})
+        }));
+    }
     pc.ontrack = function (event) {
         if (event.track.kind === 'video') {
                 console.log('收到视频轨道');
@@ -111,7 +128,7 @@ async function sendOffer(iceRestart) {
     await pc.setLocalDescription(offer);
     ws.send(JSON.stringify({
         type: 'offer',
-        data: JSON.stringify(offer)
+        data: JSON.stringify({type: offer.type, sdp: offer.sdp, trickle: true})
     }));
 }
 function keyboardClick(code) {
@@ -37,6 +37,7 @@ var videoVm = Vue.createApp({
             password:'',
             displayPower:true, // 显示开关状态
             errorMessage:'',
+            bitRate:'', // 码率/带宽估计
             lang:{},
         }
     